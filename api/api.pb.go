@@ -1,27 +1,17 @@
-// Code generated by protoc-gen-go.
+// Code generated by protoc-gen-go. DO NOT EDIT.
 // source: api.proto
-// DO NOT EDIT!
 
-/*
-Package api is a generated protocol buffer package.
-
-It is generated from these files:
-	api.proto
-
-It has these top-level messages:
-	Request
-	Response
-*/
 package api
 
-import proto "github.com/golang/protobuf/proto"
-import fmt "fmt"
-import math "math"
-import google_protobuf "github.com/golang/protobuf/ptypes/empty"
-
 import (
-	context "golang.org/x/net/context"
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	empty "github.com/golang/protobuf/ptypes/empty"
 	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
 )
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -33,56 +23,144 @@ var _ = math.Inf
 // is compatible with the proto package it is being compiled against.
 // A compilation error at this line likely means your copy of the
 // proto package needs to be updated.
-const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type OperationType int32
+
+const (
+	OperationType_PUT    OperationType = 0
+	OperationType_DELETE OperationType = 1
+)
+
+var OperationType_name = map[int32]string{
+	0: "PUT",
+	1: "DELETE",
+}
+
+var OperationType_value = map[string]int32{
+	"PUT":    0,
+	"DELETE": 1,
+}
+
+func (x OperationType) String() string {
+	return proto.EnumName(OperationType_name, int32(x))
+}
+
+func (OperationType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_00212fb1f9d3bf1c, []int{0}
+}
 
 type Request struct {
-	Key   string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
-	Value string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	Key                  []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value                []byte   `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Ttl                  int64    `protobuf:"varint,3,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Version              uint64   `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
-func (m *Request) Reset()                    { *m = Request{} }
-func (m *Request) String() string            { return proto.CompactTextString(m) }
-func (*Request) ProtoMessage()               {}
-func (*Request) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+func (m *Request) Reset()         { *m = Request{} }
+func (m *Request) String() string { return proto.CompactTextString(m) }
+func (*Request) ProtoMessage()    {}
+func (*Request) Descriptor() ([]byte, []int) {
+	return fileDescriptor_00212fb1f9d3bf1c, []int{0}
+}
 
-func (m *Request) GetKey() string {
+func (m *Request) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Request.Unmarshal(m, b)
+}
+func (m *Request) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Request.Marshal(b, m, deterministic)
+}
+func (m *Request) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Request.Merge(m, src)
+}
+func (m *Request) XXX_Size() int {
+	return xxx_messageInfo_Request.Size(m)
+}
+func (m *Request) XXX_DiscardUnknown() {
+	xxx_messageInfo_Request.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Request proto.InternalMessageInfo
+
+func (m *Request) GetKey() []byte {
 	if m != nil {
 		return m.Key
 	}
-	return ""
+	return nil
 }
 
-func (m *Request) GetValue() string {
+func (m *Request) GetValue() []byte {
 	if m != nil {
 		return m.Value
 	}
-	return ""
+	return nil
+}
+
+func (m *Request) GetTtl() int64 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+func (m *Request) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
 }
 
 type Response struct {
-	Key   string   `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
-	Value string   `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
-	Err   string   `protobuf:"bytes,3,opt,name=err" json:"err,omitempty"`
-	Keys  []string `protobuf:"bytes,4,rep,name=keys" json:"keys,omitempty"`
+	Key                  []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value                []byte   `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Err                  string   `protobuf:"bytes,3,opt,name=err,proto3" json:"err,omitempty"`
+	Keys                 [][]byte `protobuf:"bytes,4,rep,name=keys,proto3" json:"keys,omitempty"`
+	Version              uint64   `protobuf:"varint,5,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
-func (m *Response) Reset()                    { *m = Response{} }
-func (m *Response) String() string            { return proto.CompactTextString(m) }
-func (*Response) ProtoMessage()               {}
-func (*Response) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+func (m *Response) Reset()         { *m = Response{} }
+func (m *Response) String() string { return proto.CompactTextString(m) }
+func (*Response) ProtoMessage()    {}
+func (*Response) Descriptor() ([]byte, []int) {
+	return fileDescriptor_00212fb1f9d3bf1c, []int{1}
+}
 
-func (m *Response) GetKey() string {
+func (m *Response) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Response.Unmarshal(m, b)
+}
+func (m *Response) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Response.Marshal(b, m, deterministic)
+}
+func (m *Response) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Response.Merge(m, src)
+}
+func (m *Response) XXX_Size() int {
+	return xxx_messageInfo_Response.Size(m)
+}
+func (m *Response) XXX_DiscardUnknown() {
+	xxx_messageInfo_Response.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Response proto.InternalMessageInfo
+
+func (m *Response) GetKey() []byte {
 	if m != nil {
 		return m.Key
 	}
-	return ""
+	return nil
 }
 
-func (m *Response) GetValue() string {
+func (m *Response) GetValue() []byte {
 	if m != nil {
 		return m.Value
 	}
-	return ""
+	return nil
 }
 
 func (m *Response) GetErr() string {
@@ -92,16 +170,261 @@ func (m *Response) GetErr() string {
 	return ""
 }
 
-func (m *Response) GetKeys() []string {
+func (m *Response) GetKeys() [][]byte {
 	if m != nil {
 		return m.Keys
 	}
 	return nil
 }
 
+func (m *Response) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type Operation struct {
+	Type                 OperationType `protobuf:"varint,1,opt,name=type,proto3,enum=api.OperationType" json:"type,omitempty"`
+	Key                  []byte        `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Value                []byte        `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *Operation) Reset()         { *m = Operation{} }
+func (m *Operation) String() string { return proto.CompactTextString(m) }
+func (*Operation) ProtoMessage()    {}
+func (*Operation) Descriptor() ([]byte, []int) {
+	return fileDescriptor_00212fb1f9d3bf1c, []int{2}
+}
+
+func (m *Operation) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Operation.Unmarshal(m, b)
+}
+func (m *Operation) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Operation.Marshal(b, m, deterministic)
+}
+func (m *Operation) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Operation.Merge(m, src)
+}
+func (m *Operation) XXX_Size() int {
+	return xxx_messageInfo_Operation.Size(m)
+}
+func (m *Operation) XXX_DiscardUnknown() {
+	xxx_messageInfo_Operation.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Operation proto.InternalMessageInfo
+
+func (m *Operation) GetType() OperationType {
+	if m != nil {
+		return m.Type
+	}
+	return OperationType_PUT
+}
+
+func (m *Operation) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *Operation) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+type BatchRequest struct {
+	Ops                  []*Operation `protobuf:"bytes,1,rep,name=ops,proto3" json:"ops,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
+	XXX_unrecognized     []byte       `json:"-"`
+	XXX_sizecache        int32        `json:"-"`
+}
+
+func (m *BatchRequest) Reset()         { *m = BatchRequest{} }
+func (m *BatchRequest) String() string { return proto.CompactTextString(m) }
+func (*BatchRequest) ProtoMessage()    {}
+func (*BatchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_00212fb1f9d3bf1c, []int{3}
+}
+
+func (m *BatchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchRequest.Unmarshal(m, b)
+}
+func (m *BatchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchRequest.Marshal(b, m, deterministic)
+}
+func (m *BatchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchRequest.Merge(m, src)
+}
+func (m *BatchRequest) XXX_Size() int {
+	return xxx_messageInfo_BatchRequest.Size(m)
+}
+func (m *BatchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchRequest proto.InternalMessageInfo
+
+func (m *BatchRequest) GetOps() []*Operation {
+	if m != nil {
+		return m.Ops
+	}
+	return nil
+}
+
+type CompareAndSwapRequest struct {
+	Key                  []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Old                  []byte   `protobuf:"bytes,2,opt,name=old,proto3" json:"old,omitempty"`
+	Value                []byte   `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CompareAndSwapRequest) Reset()         { *m = CompareAndSwapRequest{} }
+func (m *CompareAndSwapRequest) String() string { return proto.CompactTextString(m) }
+func (*CompareAndSwapRequest) ProtoMessage()    {}
+func (*CompareAndSwapRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_00212fb1f9d3bf1c, []int{4}
+}
+
+func (m *CompareAndSwapRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CompareAndSwapRequest.Unmarshal(m, b)
+}
+func (m *CompareAndSwapRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CompareAndSwapRequest.Marshal(b, m, deterministic)
+}
+func (m *CompareAndSwapRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CompareAndSwapRequest.Merge(m, src)
+}
+func (m *CompareAndSwapRequest) XXX_Size() int {
+	return xxx_messageInfo_CompareAndSwapRequest.Size(m)
+}
+func (m *CompareAndSwapRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CompareAndSwapRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CompareAndSwapRequest proto.InternalMessageInfo
+
+func (m *CompareAndSwapRequest) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *CompareAndSwapRequest) GetOld() []byte {
+	if m != nil {
+		return m.Old
+	}
+	return nil
+}
+
+func (m *CompareAndSwapRequest) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+type RangeRequest struct {
+	Start                []byte   `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"`
+	End                  []byte   `protobuf:"bytes,2,opt,name=end,proto3" json:"end,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RangeRequest) Reset()         { *m = RangeRequest{} }
+func (m *RangeRequest) String() string { return proto.CompactTextString(m) }
+func (*RangeRequest) ProtoMessage()    {}
+func (*RangeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_00212fb1f9d3bf1c, []int{5}
+}
+
+func (m *RangeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RangeRequest.Unmarshal(m, b)
+}
+func (m *RangeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RangeRequest.Marshal(b, m, deterministic)
+}
+func (m *RangeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RangeRequest.Merge(m, src)
+}
+func (m *RangeRequest) XXX_Size() int {
+	return xxx_messageInfo_RangeRequest.Size(m)
+}
+func (m *RangeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RangeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RangeRequest proto.InternalMessageInfo
+
+func (m *RangeRequest) GetStart() []byte {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *RangeRequest) GetEnd() []byte {
+	if m != nil {
+		return m.End
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("api.OperationType", OperationType_name, OperationType_value)
 	proto.RegisterType((*Request)(nil), "api.Request")
 	proto.RegisterType((*Response)(nil), "api.Response")
+	proto.RegisterType((*Operation)(nil), "api.Operation")
+	proto.RegisterType((*BatchRequest)(nil), "api.BatchRequest")
+	proto.RegisterType((*CompareAndSwapRequest)(nil), "api.CompareAndSwapRequest")
+	proto.RegisterType((*RangeRequest)(nil), "api.RangeRequest")
+}
+
+func init() { proto.RegisterFile("api.proto", fileDescriptor_00212fb1f9d3bf1c) }
+
+var fileDescriptor_00212fb1f9d3bf1c = []byte{
+	// 490 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x52, 0x4f, 0x6f, 0xd3, 0x4e,
+	0x10, 0xad, 0xb3, 0x4e, 0xf2, 0xcb, 0xd4, 0xcd, 0x2f, 0xac, 0x0a, 0xb2, 0xc2, 0xc5, 0x8a, 0x2a,
+	0x6a, 0x01, 0x75, 0xa2, 0x20, 0x71, 0xe3, 0x50, 0xa8, 0x05, 0x55, 0x90, 0x08, 0xdb, 0xc0, 0x05,
+	0x71, 0xd8, 0x34, 0x93, 0x10, 0xd5, 0xf5, 0x6e, 0xbd, 0xeb, 0x20, 0x7f, 0x52, 0xbe, 0x0e, 0xf2,
+	0x3a, 0xae, 0x12, 0xe1, 0xca, 0x70, 0x9b, 0xd9, 0x79, 0xfb, 0xe6, 0xcf, 0x7b, 0xd0, 0xe1, 0x72,
+	0x1d, 0xc8, 0x44, 0x68, 0x41, 0x09, 0x97, 0xeb, 0xfe, 0xd3, 0x95, 0x10, 0xab, 0x08, 0x87, 0xe6,
+	0x69, 0x9e, 0x2e, 0x87, 0x78, 0x2b, 0x75, 0x56, 0x20, 0x06, 0xdf, 0xa1, 0xcd, 0xf0, 0x2e, 0x45,
+	0xa5, 0x69, 0x0f, 0xc8, 0x0d, 0x66, 0xae, 0xe5, 0x59, 0xbe, 0xc3, 0xf2, 0x90, 0x1e, 0x43, 0x73,
+	0xc3, 0xa3, 0x14, 0xdd, 0x86, 0x79, 0x2b, 0x92, 0x1c, 0xa7, 0x75, 0xe4, 0x12, 0xcf, 0xf2, 0x09,
+	0xcb, 0x43, 0xea, 0x42, 0x7b, 0x83, 0x89, 0x5a, 0x8b, 0xd8, 0xb5, 0x3d, 0xcb, 0xb7, 0x59, 0x99,
+	0x0e, 0x12, 0xf8, 0x8f, 0xa1, 0x92, 0x22, 0x56, 0xf8, 0x2f, 0xfc, 0x98, 0x24, 0x86, 0xbf, 0xc3,
+	0xf2, 0x90, 0x52, 0xb0, 0x6f, 0x30, 0x53, 0xae, 0xed, 0x11, 0xdf, 0x61, 0x26, 0xde, 0xed, 0xd9,
+	0xdc, 0xef, 0xf9, 0x0d, 0x3a, 0x9f, 0x24, 0x26, 0x5c, 0xaf, 0x45, 0x4c, 0x9f, 0x81, 0xad, 0x33,
+	0x89, 0xa6, 0x6b, 0x77, 0x4c, 0x83, 0xfc, 0x36, 0xf7, 0xd5, 0x59, 0x26, 0x91, 0x99, 0x7a, 0x39,
+	0x5c, 0xa3, 0x62, 0x38, 0xb2, 0x33, 0xdc, 0x60, 0x04, 0xce, 0x5b, 0xae, 0xaf, 0x7f, 0x94, 0x47,
+	0xf3, 0x80, 0x08, 0xa9, 0x5c, 0xcb, 0x23, 0xfe, 0xe1, 0xb8, 0xbb, 0x4f, 0xcf, 0xf2, 0xd2, 0xe0,
+	0x33, 0x3c, 0x7e, 0x27, 0x6e, 0x25, 0x4f, 0xf0, 0x3c, 0x5e, 0x5c, 0xfd, 0xe4, 0xf2, 0xe1, 0x7b,
+	0xf7, 0x80, 0x88, 0x68, 0x51, 0x0e, 0x21, 0xa2, 0xc5, 0x03, 0x43, 0xbc, 0x06, 0x87, 0xf1, 0x78,
+	0x85, 0x25, 0xd3, 0x31, 0x34, 0x95, 0xe6, 0x89, 0xde, 0x72, 0x15, 0x89, 0xb9, 0x63, 0x7c, 0xcf,
+	0x86, 0xf1, 0xe2, 0xf9, 0x09, 0x1c, 0xed, 0xed, 0x4e, 0xdb, 0x40, 0xa6, 0x5f, 0x66, 0xbd, 0x03,
+	0x0a, 0xd0, 0xba, 0x08, 0x3f, 0x86, 0xb3, 0xb0, 0x67, 0x8d, 0x7f, 0xd9, 0xd0, 0x98, 0x6c, 0xe8,
+	0x09, 0x90, 0xf7, 0xa8, 0xa9, 0x63, 0x76, 0xda, 0x76, 0xea, 0x1f, 0x6d, 0xb3, 0x42, 0xd2, 0xc1,
+	0x41, 0x8e, 0x9a, 0xa6, 0xb5, 0xa8, 0x53, 0x68, 0x5d, 0x60, 0x84, 0x1a, 0xeb, 0x80, 0x43, 0xb0,
+	0x27, 0xb9, 0xba, 0x4f, 0x82, 0xc2, 0xb4, 0x41, 0x69, 0xda, 0x20, 0xcc, 0x4d, 0x5b, 0xc9, 0xfc,
+	0x81, 0xab, 0x09, 0x66, 0x75, 0xcc, 0x2f, 0xa0, 0x69, 0x84, 0xa3, 0x8f, 0x4c, 0x65, 0x57, 0xc4,
+	0x3f, 0xc1, 0x2f, 0xe1, 0x70, 0x9a, 0xea, 0xcb, 0xe5, 0xf9, 0x5c, 0x61, 0x5c, 0xbb, 0xdd, 0x1b,
+	0xe8, 0xee, 0x2b, 0x4c, 0xfb, 0x06, 0x52, 0x29, 0x7b, 0xd5, 0xce, 0xdd, 0xe2, 0x38, 0x97, 0xcb,
+	0xf0, 0x2e, 0xe5, 0x91, 0xaa, 0xeb, 0x77, 0x06, 0x8e, 0x99, 0xee, 0x6b, 0x61, 0xf8, 0x3a, 0xf8,
+	0x08, 0xfe, 0x2f, 0xf9, 0xff, 0xf2, 0xc7, 0x29, 0xd8, 0x57, 0xd7, 0xbc, 0x0e, 0x36, 0xb2, 0xe8,
+	0x19, 0x34, 0x8d, 0x11, 0xb7, 0x47, 0xdd, 0x35, 0x65, 0x05, 0x7c, 0xde, 0x32, 0x6a, 0xbe, 0xfa,
+	0x3d, 0x00, 0x07, 0xa9, 0x1c, 0x74, 0xa2, 0x04, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -112,14 +435,23 @@ var _ grpc.ClientConn
 // is compatible with the grpc package it is being compiled against.
 const _ = grpc.SupportPackageIsVersion4
 
-// Client API for Kv service
-
+// KvClient is the client API for Kv service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type KvClient interface {
 	Get(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
 	Put(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
 	Delete(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
-	Keys(ctx context.Context, in *google_protobuf.Empty, opts ...grpc.CallOption) (*Response, error)
+	Keys(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*Response, error)
 	HasKey(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
+	Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*Response, error)
+	PutIfAbsent(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
+	CompareAndSwap(ctx context.Context, in *CompareAndSwapRequest, opts ...grpc.CallOption) (*Response, error)
+	DeleteIfEquals(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
+	PutIfVersion(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
+	DeleteIfVersion(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
+	Scan(ctx context.Context, in *Request, opts ...grpc.CallOption) (Kv_ScanClient, error)
+	Range(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (Kv_RangeClient, error)
 }
 
 type kvClient struct {
@@ -132,7 +464,7 @@ func NewKvClient(cc *grpc.ClientConn) KvClient {
 
 func (c *kvClient) Get(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
 	out := new(Response)
-	err := grpc.Invoke(ctx, "/api.Kv/Get", in, out, c.cc, opts...)
+	err := c.cc.Invoke(ctx, "/api.Kv/Get", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +473,7 @@ func (c *kvClient) Get(ctx context.Context, in *Request, opts ...grpc.CallOption
 
 func (c *kvClient) Put(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
 	out := new(Response)
-	err := grpc.Invoke(ctx, "/api.Kv/Put", in, out, c.cc, opts...)
+	err := c.cc.Invoke(ctx, "/api.Kv/Put", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -150,16 +482,16 @@ func (c *kvClient) Put(ctx context.Context, in *Request, opts ...grpc.CallOption
 
 func (c *kvClient) Delete(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
 	out := new(Response)
-	err := grpc.Invoke(ctx, "/api.Kv/Delete", in, out, c.cc, opts...)
+	err := c.cc.Invoke(ctx, "/api.Kv/Delete", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func (c *kvClient) Keys(ctx context.Context, in *google_protobuf.Empty, opts ...grpc.CallOption) (*Response, error) {
+func (c *kvClient) Keys(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*Response, error) {
 	out := new(Response)
-	err := grpc.Invoke(ctx, "/api.Kv/Keys", in, out, c.cc, opts...)
+	err := c.cc.Invoke(ctx, "/api.Kv/Keys", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -168,21 +500,190 @@ func (c *kvClient) Keys(ctx context.Context, in *google_protobuf.Empty, opts ...
 
 func (c *kvClient) HasKey(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
 	out := new(Response)
-	err := grpc.Invoke(ctx, "/api.Kv/HasKey", in, out, c.cc, opts...)
+	err := c.cc.Invoke(ctx, "/api.Kv/HasKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvClient) Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/api.Kv/Batch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvClient) PutIfAbsent(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/api.Kv/PutIfAbsent", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-// Server API for Kv service
+func (c *kvClient) CompareAndSwap(ctx context.Context, in *CompareAndSwapRequest, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/api.Kv/CompareAndSwap", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvClient) DeleteIfEquals(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/api.Kv/DeleteIfEquals", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
+func (c *kvClient) PutIfVersion(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/api.Kv/PutIfVersion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvClient) DeleteIfVersion(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/api.Kv/DeleteIfVersion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvClient) Scan(ctx context.Context, in *Request, opts ...grpc.CallOption) (Kv_ScanClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Kv_serviceDesc.Streams[0], "/api.Kv/Scan", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kvScanClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Kv_ScanClient interface {
+	Recv() (*Response, error)
+	grpc.ClientStream
+}
+
+type kvScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *kvScanClient) Recv() (*Response, error) {
+	m := new(Response)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *kvClient) Range(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (Kv_RangeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Kv_serviceDesc.Streams[1], "/api.Kv/Range", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kvRangeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Kv_RangeClient interface {
+	Recv() (*Response, error)
+	grpc.ClientStream
+}
+
+type kvRangeClient struct {
+	grpc.ClientStream
+}
+
+func (x *kvRangeClient) Recv() (*Response, error) {
+	m := new(Response)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KvServer is the server API for Kv service.
 type KvServer interface {
 	Get(context.Context, *Request) (*Response, error)
 	Put(context.Context, *Request) (*Response, error)
 	Delete(context.Context, *Request) (*Response, error)
-	Keys(context.Context, *google_protobuf.Empty) (*Response, error)
+	Keys(context.Context, *empty.Empty) (*Response, error)
 	HasKey(context.Context, *Request) (*Response, error)
+	Batch(context.Context, *BatchRequest) (*Response, error)
+	PutIfAbsent(context.Context, *Request) (*Response, error)
+	CompareAndSwap(context.Context, *CompareAndSwapRequest) (*Response, error)
+	DeleteIfEquals(context.Context, *Request) (*Response, error)
+	PutIfVersion(context.Context, *Request) (*Response, error)
+	DeleteIfVersion(context.Context, *Request) (*Response, error)
+	Scan(*Request, Kv_ScanServer) error
+	Range(*RangeRequest, Kv_RangeServer) error
+}
+
+// UnimplementedKvServer can be embedded to have forward compatible implementations.
+type UnimplementedKvServer struct {
+}
+
+func (*UnimplementedKvServer) Get(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (*UnimplementedKvServer) Put(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (*UnimplementedKvServer) Delete(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (*UnimplementedKvServer) Keys(ctx context.Context, req *empty.Empty) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Keys not implemented")
+}
+func (*UnimplementedKvServer) HasKey(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HasKey not implemented")
+}
+func (*UnimplementedKvServer) Batch(ctx context.Context, req *BatchRequest) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Batch not implemented")
+}
+func (*UnimplementedKvServer) PutIfAbsent(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutIfAbsent not implemented")
+}
+func (*UnimplementedKvServer) CompareAndSwap(ctx context.Context, req *CompareAndSwapRequest) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CompareAndSwap not implemented")
+}
+func (*UnimplementedKvServer) DeleteIfEquals(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteIfEquals not implemented")
+}
+func (*UnimplementedKvServer) PutIfVersion(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutIfVersion not implemented")
+}
+func (*UnimplementedKvServer) DeleteIfVersion(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteIfVersion not implemented")
+}
+func (*UnimplementedKvServer) Scan(req *Request, srv Kv_ScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (*UnimplementedKvServer) Range(req *RangeRequest, srv Kv_RangeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Range not implemented")
 }
 
 func RegisterKvServer(s *grpc.Server, srv KvServer) {
@@ -244,7 +745,7 @@ func _Kv_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface
 }
 
 func _Kv_Keys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(google_protobuf.Empty)
+	in := new(empty.Empty)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -256,7 +757,7 @@ func _Kv_Keys_Handler(srv interface{}, ctx context.Context, dec func(interface{}
 		FullMethod: "/api.Kv/Keys",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(KvServer).Keys(ctx, req.(*google_protobuf.Empty))
+		return srv.(KvServer).Keys(ctx, req.(*empty.Empty))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -279,6 +780,156 @@ func _Kv_HasKey_Handler(srv interface{}, ctx context.Context, dec func(interface
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Kv_Batch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KvServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Kv/Batch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KvServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kv_PutIfAbsent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KvServer).PutIfAbsent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Kv/PutIfAbsent",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KvServer).PutIfAbsent(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kv_CompareAndSwap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompareAndSwapRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KvServer).CompareAndSwap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Kv/CompareAndSwap",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KvServer).CompareAndSwap(ctx, req.(*CompareAndSwapRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kv_DeleteIfEquals_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KvServer).DeleteIfEquals(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Kv/DeleteIfEquals",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KvServer).DeleteIfEquals(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kv_PutIfVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KvServer).PutIfVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Kv/PutIfVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KvServer).PutIfVersion(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kv_DeleteIfVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KvServer).DeleteIfVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Kv/DeleteIfVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KvServer).DeleteIfVersion(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kv_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Request)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KvServer).Scan(m, &kvScanServer{stream})
+}
+
+type Kv_ScanServer interface {
+	Send(*Response) error
+	grpc.ServerStream
+}
+
+type kvScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *kvScanServer) Send(m *Response) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Kv_Range_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RangeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KvServer).Range(m, &kvRangeServer{stream})
+}
+
+type Kv_RangeServer interface {
+	Send(*Response) error
+	grpc.ServerStream
+}
+
+type kvRangeServer struct {
+	grpc.ServerStream
+}
+
+func (x *kvRangeServer) Send(m *Response) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _Kv_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "api.Kv",
 	HandlerType: (*KvServer)(nil),
@@ -303,28 +954,42 @@ var _Kv_serviceDesc = grpc.ServiceDesc{
 			MethodName: "HasKey",
 			Handler:    _Kv_HasKey_Handler,
 		},
+		{
+			MethodName: "Batch",
+			Handler:    _Kv_Batch_Handler,
+		},
+		{
+			MethodName: "PutIfAbsent",
+			Handler:    _Kv_PutIfAbsent_Handler,
+		},
+		{
+			MethodName: "CompareAndSwap",
+			Handler:    _Kv_CompareAndSwap_Handler,
+		},
+		{
+			MethodName: "DeleteIfEquals",
+			Handler:    _Kv_DeleteIfEquals_Handler,
+		},
+		{
+			MethodName: "PutIfVersion",
+			Handler:    _Kv_PutIfVersion_Handler,
+		},
+		{
+			MethodName: "DeleteIfVersion",
+			Handler:    _Kv_DeleteIfVersion_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _Kv_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Range",
+			Handler:       _Kv_Range_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "api.proto",
 }
-
-func init() { proto.RegisterFile("api.proto", fileDescriptor0) }
-
-var fileDescriptor0 = []byte{
-	// 227 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x90, 0xcf, 0x4a, 0x03, 0x31,
-	0x18, 0xc4, 0xdd, 0x66, 0xad, 0xee, 0x87, 0x82, 0x7c, 0x88, 0x2c, 0xf5, 0x52, 0x16, 0xc1, 0x9e,
-	0xb2, 0xa8, 0xaf, 0xa0, 0x28, 0xec, 0x45, 0xf6, 0xe4, 0x75, 0x0b, 0x63, 0x29, 0x5d, 0x4d, 0xcc,
-	0x9f, 0x42, 0x9e, 0xd3, 0x17, 0x92, 0x24, 0xf5, 0x26, 0xac, 0xb7, 0x99, 0xe1, 0x97, 0x49, 0x32,
-	0x54, 0x0d, 0x7a, 0x2b, 0xb5, 0x51, 0x4e, 0xb1, 0x18, 0xf4, 0x76, 0x71, 0xbd, 0x51, 0x6a, 0x33,
-	0xa2, 0x4d, 0xd1, 0xda, 0xbf, 0xb7, 0xf8, 0xd0, 0x2e, 0x64, 0xa2, 0xb9, 0xa3, 0x93, 0x1e, 0x5f,
-	0x1e, 0xd6, 0xf1, 0x05, 0x89, 0x1d, 0x42, 0x5d, 0x2c, 0x8b, 0x55, 0xd5, 0x47, 0xc9, 0x97, 0x74,
-	0xbc, 0x1f, 0x46, 0x8f, 0x7a, 0x96, 0xb2, 0x6c, 0x9a, 0x37, 0x3a, 0xed, 0x61, 0xb5, 0xfa, 0xb4,
-	0xf8, 0xef, 0x99, 0xc8, 0xc1, 0x98, 0x5a, 0x64, 0x0e, 0xc6, 0x30, 0x53, 0xb9, 0x43, 0xb0, 0x75,
-	0xb9, 0x14, 0xab, 0xaa, 0x4f, 0xfa, 0xfe, 0xbb, 0xa0, 0x59, 0xb7, 0xe7, 0x1b, 0x12, 0xcf, 0x70,
-	0x7c, 0x26, 0xe3, 0x47, 0x0e, 0xaf, 0x5b, 0x9c, 0x1f, 0x5c, 0xbe, 0xb8, 0x39, 0x8a, 0xd4, 0xab,
-	0x9f, 0xa4, 0x6e, 0x69, 0xfe, 0x88, 0x11, 0x0e, 0x53, 0x60, 0x4b, 0x65, 0x87, 0x60, 0xf9, 0x4a,
-	0xe6, 0xb9, 0xe4, 0xef, 0x5c, 0xf2, 0x29, 0xce, 0xf5, 0x67, 0xf3, 0xcb, 0x60, 0x3b, 0x84, 0x89,
-	0xe6, 0xf5, 0x3c, 0x35, 0x3d, 0xfc, 0x04, 0x00, 0x00, 0xff, 0xff, 0x70, 0x63, 0x30, 0x95, 0x98,
-	0x01, 0x00, 0x00,
-}
@@ -2,10 +2,13 @@ package api
 
 import (
 	"log"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/nikosl/gkvd/internal/bitcask"
 	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Server represents the gRPC server.
@@ -23,22 +26,28 @@ func New(db *bitcask.Bitcask) *Server {
 // Get from db.
 func (s *Server) Get(ctx context.Context, in *Request) (*Response, error) {
 	log.Printf("Receive message Get key: %s", in.Key)
-	k, v, err := s.db.Get(in.Key)
+	v, version, err := s.db.GetVersioned(in.Key)
 	e := ""
 	if err != nil {
 		e = err.Error()
 	}
 	return &Response{
-		Key:   k,
-		Value: v,
-		Err:   e,
+		Key:     in.Key,
+		Value:   v,
+		Err:     e,
+		Version: version,
 	}, nil
 }
 
-// Put key value in db.
+// Put key value in db. A positive ttl, in seconds, expires the key.
 func (s *Server) Put(ctx context.Context, in *Request) (*Response, error) {
-	log.Printf("Receive message Put key: %s value: %s", in.Key, in.Value)
-	err := s.db.Put(in.Key, in.Value)
+	log.Printf("Receive message Put key: %s value: %s ttl: %d", in.Key, in.Value, in.Ttl)
+	var err error
+	if in.Ttl > 0 {
+		err = s.db.PutBytesWithTTL(in.Key, in.Value, time.Duration(in.Ttl)*time.Second)
+	} else {
+		err = s.db.PutBytes(in.Key, in.Value)
+	}
 	e := ""
 	if err != nil {
 		e = err.Error()
@@ -53,7 +62,7 @@ func (s *Server) Put(ctx context.Context, in *Request) (*Response, error) {
 // Delete key from db.
 func (s *Server) Delete(ctx context.Context, in *Request) (*Response, error) {
 	log.Printf("Receive message Delete key: %s", in.Key)
-	err := s.db.Delete(in.Key)
+	err := s.db.DeleteBytes(in.Key)
 	e := ""
 	if err != nil {
 		e = err.Error()
@@ -67,7 +76,7 @@ func (s *Server) Delete(ctx context.Context, in *Request) (*Response, error) {
 // Keys returns existing keyes.
 func (s *Server) Keys(ctx context.Context, in *empty.Empty) (*Response, error) {
 	log.Printf("Receive message Keys")
-	keys := s.db.Keys()
+	keys := s.db.KeysBytes()
 	return &Response{
 		Keys: keys,
 	}, nil
@@ -76,8 +85,8 @@ func (s *Server) Keys(ctx context.Context, in *empty.Empty) (*Response, error) {
 // HasKey return the key if key exists in db.
 func (s *Server) HasKey(ctx context.Context, in *Request) (*Response, error) {
 	log.Printf("Receive message HasKey key: %s", in.Key)
-	exists := s.db.HasKey(in.Key)
-	k := ""
+	exists := s.db.HasKeyBytes(in.Key)
+	var k []byte
 	if exists {
 		k = in.Key
 	}
@@ -85,3 +94,131 @@ func (s *Server) HasKey(ctx context.Context, in *Request) (*Response, error) {
 		Key: k,
 	}, nil
 }
+
+// Batch applies the operations atomically.
+func (s *Server) Batch(ctx context.Context, in *BatchRequest) (*Response, error) {
+	log.Printf("Receive message Batch ops: %d", len(in.Ops))
+	b := bitcask.NewBatch()
+	for _, op := range in.Ops {
+		switch op.Type {
+		case OperationType_PUT:
+			b.PutBytes(op.Key, op.Value)
+		case OperationType_DELETE:
+			b.DeleteBytes(op.Key)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown operation type %d", op.Type)
+		}
+	}
+	err := s.db.Write(b)
+	e := ""
+	if err != nil {
+		e = err.Error()
+	}
+	return &Response{
+		Err: e,
+	}, nil
+}
+
+// PutIfAbsent adds key value to db only if the key does not exist.
+func (s *Server) PutIfAbsent(ctx context.Context, in *Request) (*Response, error) {
+	log.Printf("Receive message PutIfAbsent key: %s value: %s", in.Key, in.Value)
+	err := s.db.PutIfAbsentBytes(in.Key, in.Value)
+	e := ""
+	if err != nil {
+		e = err.Error()
+	}
+	return &Response{
+		Key:   in.Key,
+		Value: in.Value,
+		Err:   e,
+	}, nil
+}
+
+// CompareAndSwap replaces the value of key only if it equals old.
+func (s *Server) CompareAndSwap(ctx context.Context, in *CompareAndSwapRequest) (*Response, error) {
+	log.Printf("Receive message CompareAndSwap key: %s old: %s value: %s", in.Key, in.Old, in.Value)
+	err := s.db.CompareAndSwapBytes(in.Key, in.Old, in.Value)
+	e := ""
+	if err != nil {
+		e = err.Error()
+	}
+	return &Response{
+		Key:   in.Key,
+		Value: in.Value,
+		Err:   e,
+	}, nil
+}
+
+// DeleteIfEquals deletes key from db only if its value equals value.
+func (s *Server) DeleteIfEquals(ctx context.Context, in *Request) (*Response, error) {
+	log.Printf("Receive message DeleteIfEquals key: %s value: %s", in.Key, in.Value)
+	err := s.db.DeleteIfEqualsBytes(in.Key, in.Value)
+	e := ""
+	if err != nil {
+		e = err.Error()
+	}
+	return &Response{
+		Key: in.Key,
+		Err: e,
+	}, nil
+}
+
+// PutIfVersion adds key value to db only if the key is at version.
+// Version 0 requires the key to be missing.
+func (s *Server) PutIfVersion(ctx context.Context, in *Request) (*Response, error) {
+	log.Printf("Receive message PutIfVersion key: %s value: %s version: %d", in.Key, in.Value, in.Version)
+	err := s.db.PutIfVersion(in.Key, in.Value, in.Version)
+	e := ""
+	if err != nil {
+		e = err.Error()
+	}
+	return &Response{
+		Key:   in.Key,
+		Value: in.Value,
+		Err:   e,
+	}, nil
+}
+
+// DeleteIfVersion deletes key from db only if the key is at version.
+func (s *Server) DeleteIfVersion(ctx context.Context, in *Request) (*Response, error) {
+	log.Printf("Receive message DeleteIfVersion key: %s version: %d", in.Key, in.Version)
+	err := s.db.DeleteIfVersion(in.Key, in.Version)
+	e := ""
+	if err != nil {
+		e = err.Error()
+	}
+	return &Response{
+		Key: in.Key,
+		Err: e,
+	}, nil
+}
+
+// Scan streams the keys starting with the requested key and their values.
+func (s *Server) Scan(in *Request, stream Kv_ScanServer) error {
+	log.Printf("Receive message Scan prefix: %s", in.Key)
+	return send(s.db.Scan(in.Key), stream)
+}
+
+// Range streams the keys from start, inclusive, to end, exclusive, and
+// their values.
+func (s *Server) Range(in *RangeRequest, stream Kv_RangeServer) error {
+	log.Printf("Receive message Range start: %s end: %s", in.Start, in.End)
+	return send(s.db.Range(in.Start, in.End), stream)
+}
+
+func send(it *bitcask.Iterator, stream interface{ Send(*Response) error }) error {
+	for it.Next() {
+		if err := stream.Send(&Response{
+			Key:   it.Key(),
+			Value: it.Value(),
+		}); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return stream.Send(&Response{
+			Err: err.Error(),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/nikosl/gkvd/internal/bitcask"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetUsesValueCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bitcask.Open(dir, bitcask.WithAutoMerge(false), bitcask.WithValueCache(1<<10))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	s := New(db)
+	ctx := context.Background()
+	if _, err := s.Put(ctx, &Request{Key: []byte("a"), Value: []byte("1")}); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := s.Get(ctx, &Request{Key: []byte("a")})
+		if err != nil || resp.Err != "" || string(resp.Value) != "1" {
+			t.Fatalf("expected %v but got %v, err %v", "1", resp, err)
+		}
+	}
+	want := bitcask.CacheStats{Hits: 1, Misses: 1, Entries: 1, Bytes: 2}
+	if got := db.CacheStats(); got != want {
+		t.Errorf("expected %+v but got %+v", want, got)
+	}
+}
+
+func TestBatchRejectsUnknownOperation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bitcask.Open(dir, bitcask.WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	s := New(db)
+	in := &BatchRequest{Ops: []*Operation{
+		{Type: OperationType_PUT, Key: []byte("a"), Value: []byte("1")},
+		{Type: OperationType(7), Key: []byte("b"), Value: []byte("2")},
+	}}
+	if _, err := s.Batch(context.Background(), in); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected %v but got %v", codes.InvalidArgument, err)
+	}
+	if db.HasKey("a") || db.HasKey("b") {
+		t.Errorf("expected no keys but got %v", db.Keys())
+	}
+}
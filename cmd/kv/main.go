@@ -4,8 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/nikosl/gkvd/api"
@@ -15,6 +17,8 @@ import (
 func main() {
 	var putf bool
 	flag.BoolVar(&putf, "put", false, "add or modify a key value")
+	var ttl time.Duration
+	flag.DurationVar(&ttl, "ttl", 0, "expire the put key after the given duration")
 	var getf bool
 	flag.BoolVar(&getf, "get", false, "returns the value of a key")
 	var delf bool
@@ -23,7 +27,23 @@ func main() {
 	flag.BoolVar(&ksf, "keys", false, "returns all the existing keys")
 	var haskeyf bool
 	flag.BoolVar(&haskeyf, "has", false, "check if key exist")
+	var putnxf bool
+	flag.BoolVar(&putnxf, "putnx", false, "add a key value only if the key does not exist")
+	var casf bool
+	flag.BoolVar(&casf, "cas", false, "replace the value of a key only if it equals the given old value")
+	var delif bool
+	flag.BoolVar(&delif, "delif", false, "deletes the given key only if it has the given value")
+	var scanf bool
+	flag.BoolVar(&scanf, "scan", false, "returns the key values starting with the given prefix")
+	var rangef bool
+	flag.BoolVar(&rangef, "range", false, "returns the key values from start up to an optional end")
+	var version int64
+	flag.Int64Var(&version, "version", -1, "make -put and -del conditional on the key version, 0 for a missing key")
 	flag.Parse()
+	if version >= 0 && ttl != 0 {
+		fmt.Fprintf(os.Stderr, "-ttl cannot be used with -version")
+		os.Exit(-1)
+	}
 
 	var conn *grpc.ClientConn
 	conn, err := grpc.Dial(":7777", grpc.WithInsecure())
@@ -40,7 +60,13 @@ func main() {
 			fmt.Fprintf(os.Stderr, "not enought arguments")
 			os.Exit(-1)
 		}
-		if ok := put(c, args[0], args[1]); ok {
+		ok := false
+		if version >= 0 {
+			ok = putIfVersion(c, args[0], args[1], uint64(version))
+		} else {
+			ok = put(c, args[0], args[1], ttl)
+		}
+		if ok {
 			fmt.Fprintf(os.Stdout, "{\"%s\":\"%s\"}", args[0], args[1])
 			os.Exit(0)
 		}
@@ -51,8 +77,8 @@ func main() {
 			fmt.Fprintf(os.Stderr, "not enought arguments")
 			os.Exit(-1)
 		}
-		if val := get(c, args[0]); val != "" {
-			fmt.Fprintf(os.Stdout, "{\"%s\":\"%s\"}", args[0], val)
+		if val, version := get(c, args[0]); val != "" {
+			fmt.Fprintf(os.Stdout, "{\"%s\":\"%s\",\"version\":%d}", args[0], val, version)
 			os.Exit(0)
 		}
 		fmt.Fprintf(os.Stderr, "failed to add value")
@@ -62,7 +88,13 @@ func main() {
 			fmt.Fprintf(os.Stderr, "not enought arguments")
 			os.Exit(-1)
 		}
-		if ok := del(c, args[0]); ok {
+		ok := false
+		if version >= 0 {
+			ok = delIfVersion(c, args[0], uint64(version))
+		} else {
+			ok = del(c, args[0])
+		}
+		if ok {
 			fmt.Fprintf(os.Stdout, "{\"delete\":\"%s\"}", args[0])
 			os.Exit(0)
 		}
@@ -80,6 +112,67 @@ func main() {
 			fmt.Fprintf(os.Stdout, "{\"%s\":%t}", args[0], ok)
 			os.Exit(1)
 		}
+	case putnxf:
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "not enought arguments")
+			os.Exit(-1)
+		}
+		if ok := putIfAbsent(c, args[0], args[1]); ok {
+			fmt.Fprintf(os.Stdout, "{\"%s\":\"%s\"}", args[0], args[1])
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "key already exists")
+		os.Exit(1)
+	case casf:
+		if len(args) != 3 {
+			fmt.Fprintf(os.Stderr, "not enought arguments")
+			os.Exit(-1)
+		}
+		if ok := compareAndSwap(c, args[0], args[1], args[2]); ok {
+			fmt.Fprintf(os.Stdout, "{\"%s\":\"%s\"}", args[0], args[2])
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "value does not match")
+		os.Exit(1)
+	case delif:
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "not enought arguments")
+			os.Exit(-1)
+		}
+		if ok := delIfEquals(c, args[0], args[1]); ok {
+			fmt.Fprintf(os.Stdout, "{\"delete\":\"%s\"}", args[0])
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "value does not match")
+		os.Exit(1)
+	case scanf:
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "not enought arguments")
+			os.Exit(-1)
+		}
+		stream, err := c.Scan(context.Background(), &api.Request{
+			Key: []byte(args[0]),
+		})
+		if err != nil {
+			log.Fatalf("Error when calling Scan: %s", err)
+		}
+		os.Exit(receive(stream))
+	case rangef:
+		if len(args) != 1 && len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "not enought arguments")
+			os.Exit(-1)
+		}
+		r := &api.RangeRequest{
+			Start: []byte(args[0]),
+		}
+		if len(args) == 2 {
+			r.End = []byte(args[1])
+		}
+		stream, err := c.Range(context.Background(), r)
+		if err != nil {
+			log.Fatalf("Error when calling Range: %s", err)
+		}
+		os.Exit(receive(stream))
 	case ksf:
 		k := keys(c)
 		fmt.Fprintf(os.Stderr, "{\"keys\":%v}", k)
@@ -87,10 +180,11 @@ func main() {
 	}
 }
 
-func put(c api.KvClient, key, value string) bool {
+func put(c api.KvClient, key, value string, ttl time.Duration) bool {
 	response, err := c.Put(context.Background(), &api.Request{
-		Key:   key,
-		Value: value,
+		Key:   []byte(key),
+		Value: []byte(value),
+		Ttl:   int64((ttl + time.Second - 1) / time.Second),
 	})
 	if err != nil {
 		log.Fatalf("Error when calling Put: %s", err)
@@ -101,19 +195,19 @@ func put(c api.KvClient, key, value string) bool {
 	return false
 }
 
-func get(c api.KvClient, key string) string {
+func get(c api.KvClient, key string) (string, uint64) {
 	response, err := c.Get(context.Background(), &api.Request{
-		Key: key,
+		Key: []byte(key),
 	})
 	if err != nil {
 		log.Fatalf("Error when calling Get: %s", err)
 	}
-	return response.Value
+	return string(response.Value), response.Version
 }
 
 func del(c api.KvClient, key string) bool {
 	response, err := c.Delete(context.Background(), &api.Request{
-		Key: key,
+		Key: []byte(key),
 	})
 	if err != nil {
 		log.Fatalf("Error when calling SayHello: %s", err)
@@ -126,15 +220,95 @@ func keys(c api.KvClient) []string {
 	if err != nil {
 		log.Fatalf("Error when calling SayHello: %s", err)
 	}
-	return response.Keys
+	ks := make([]string, 0, len(response.Keys))
+	for _, k := range response.Keys {
+		ks = append(ks, string(k))
+	}
+	return ks
 }
 
 func hasKey(c api.KvClient, key string) bool {
 	response, err := c.HasKey(context.Background(), &api.Request{
-		Key: key,
+		Key: []byte(key),
 	})
 	if err != nil {
 		log.Fatalf("Error when calling SayHello: %s", err)
 	}
-	return response.Key != ""
+	return len(response.Key) != 0
+}
+
+func putIfAbsent(c api.KvClient, key, value string) bool {
+	response, err := c.PutIfAbsent(context.Background(), &api.Request{
+		Key:   []byte(key),
+		Value: []byte(value),
+	})
+	if err != nil {
+		log.Fatalf("Error when calling PutIfAbsent: %s", err)
+	}
+	return response.Err == ""
+}
+
+func compareAndSwap(c api.KvClient, key, old, value string) bool {
+	response, err := c.CompareAndSwap(context.Background(), &api.CompareAndSwapRequest{
+		Key:   []byte(key),
+		Old:   []byte(old),
+		Value: []byte(value),
+	})
+	if err != nil {
+		log.Fatalf("Error when calling CompareAndSwap: %s", err)
+	}
+	return response.Err == ""
+}
+
+func delIfEquals(c api.KvClient, key, value string) bool {
+	response, err := c.DeleteIfEquals(context.Background(), &api.Request{
+		Key:   []byte(key),
+		Value: []byte(value),
+	})
+	if err != nil {
+		log.Fatalf("Error when calling DeleteIfEquals: %s", err)
+	}
+	return response.Err == ""
+}
+
+func putIfVersion(c api.KvClient, key, value string, version uint64) bool {
+	response, err := c.PutIfVersion(context.Background(), &api.Request{
+		Key:     []byte(key),
+		Value:   []byte(value),
+		Version: version,
+	})
+	if err != nil {
+		log.Fatalf("Error when calling PutIfVersion: %s", err)
+	}
+	return response.Err == ""
+}
+
+func delIfVersion(c api.KvClient, key string, version uint64) bool {
+	response, err := c.DeleteIfVersion(context.Background(), &api.Request{
+		Key:     []byte(key),
+		Version: version,
+	})
+	if err != nil {
+		log.Fatalf("Error when calling DeleteIfVersion: %s", err)
+	}
+	return response.Err == ""
+}
+
+// receive prints the key values of a Scan or Range stream, one per line,
+// and returns the exit code.
+func receive(stream interface{ Recv() (*api.Response, error) }) int {
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			log.Fatalf("Error when receiving: %s", err)
+		}
+		if response.Err != "" {
+			fmt.Fprintf(os.Stderr, "%s", response.Err)
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "{\"%s\":\"%s\"}\n", response.Key, response.Value)
+	}
 }
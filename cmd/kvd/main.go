@@ -1,25 +1,111 @@
 package main
 
 import (
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/nikosl/gkvd/api"
 	"github.com/nikosl/gkvd/internal/bitcask"
 	"google.golang.org/grpc"
 )
 
+const dataDir = "/tmp/bitcask_srv"
+
 func main() {
+	var recoverf bool
+	flag.BoolVar(&recoverf, "recover", false, "repair corrupt data files while opening the store")
+	var compressf bool
+	flag.BoolVar(&compressf, "compress", false, "compress values when they are written")
+	var mmapf bool
+	flag.BoolVar(&mmapf, "mmap", false, "read immutable data files through memory mappings")
+	var cacheBytes int64
+	flag.Int64Var(&cacheBytes, "cache-bytes", 0, "cache recently read values up to this many bytes, 0 to disable")
+	var statsf time.Duration
+	flag.DurationVar(&statsf, "stats-interval", 0, "log keydir memory and cache counters at this interval, 0 to disable")
+	var checkpointf time.Duration
+	flag.DurationVar(&checkpointf, "checkpoint-interval", 5*time.Minute, "save the keydir for fast startup at this interval, 0 to disable")
+	var loadf int
+	flag.IntVar(&loadf, "load-parallelism", 0, "read this many data files at once while opening the store, 0 for one per CPU")
+	var syncf string
+	flag.StringVar(&syncf, "sync", "never", "flush writes to disk: always, never or an interval such as 1s")
+	var keyfile string
+	flag.StringVar(&keyfile, "keyfile", "", "file with the hex encoded AES key that encrypts the store")
+	var rotatef string
+	flag.StringVar(&rotatef, "rotate-keyfile", "", "re-encrypt the store with the key in this file and exit")
+	var merge bitcask.MergePolicy
+	flag.IntVar(&merge.DeadPercent, "merge-dead", 0, "merge only data files with at least this percentage of dead bytes")
+	flag.IntVar(&merge.MaxFiles, "merge-files", 0, "merge at most this many data files at a time, 0 for all")
+	flag.Int64Var(&merge.MaxBytes, "merge-bytes", 0, "copy at most this many bytes per merge, 0 for no limit")
+	var mergeRate int64
+	flag.Int64Var(&mergeRate, "merge-rate", 0, "limit merge I/O to this many bytes per second, 0 for no limit")
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		migrate(keyfile, flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
+	policy, err := syncPolicy(syncf)
+	if err != nil {
+		log.Fatalf("invalid sync policy: %s", err)
+	}
+	key, err := readKeyFile(keyfile)
+	if err != nil {
+		log.Fatalf("failed to read key file: %s", err)
+	}
+
+	if rotatef != "" {
+		newKey, err := readKeyFile(rotatef)
+		if err != nil {
+			log.Fatalf("failed to read key file: %s", err)
+		}
+		db, err := bitcask.Open(dataDir, bitcask.WithEncryptionKey(key), bitcask.WithAutoMerge(false))
+		if err != nil {
+			log.Fatalf("failed to open directory: %s", err)
+		}
+		if err := db.RotateKey(newKey); err != nil {
+			log.Fatalf("failed to rotate key: %s", err)
+		}
+		db.Close()
+		log.Printf("store re-encrypted with %s", rotatef)
+		return
+	}
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", 7777))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	db, err := bitcask.Open("/tmp/bitcask_srv")
+	db, err := bitcask.Open(dataDir, bitcask.WithRecovery(recoverf), bitcask.WithSync(policy),
+		bitcask.WithCompression(compressf), bitcask.WithEncryptionKey(key), bitcask.WithMergePolicy(merge),
+		bitcask.WithMergeRate(mergeRate), bitcask.WithMmap(mmapf),
+		bitcask.WithValueCache(cacheBytes), bitcask.WithCheckpointInterval(checkpointf),
+		bitcask.WithLoadParallelism(loadf))
 	if err != nil {
 		log.Fatalf("failed to open directory: %s", err)
 	}
+	for _, f := range db.Recovery().Files {
+		log.Printf("recovered %s: kept %d bytes, lost %d bytes, quarantined %t: %s",
+			f.Name, f.Offset, f.LostBytes, f.Quarantined, f.Err)
+	}
+	logStats(db)
+	if statsf > 0 {
+		go func() {
+			for range time.Tick(statsf) {
+				logStats(db)
+			}
+		}()
+	}
 	s := api.New(db)
 	grpcServer := grpc.NewServer()
 
@@ -30,3 +116,64 @@ func main() {
 		log.Fatalf("failed to serve: %s", err)
 	}
 }
+
+// migrate rewrites the data files of the store in the current format. Its
+// flags follow the command, as in kvd migrate -keyfile key.
+func migrate(keyfile string, args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&keyfile, "keyfile", keyfile, "file with the hex encoded AES key that encrypts the store")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		log.Fatalf("unexpected arguments %q", fs.Args())
+	}
+	key, err := readKeyFile(keyfile)
+	if err != nil {
+		log.Fatalf("failed to read key file: %s", err)
+	}
+	n, err := bitcask.Migrate(dataDir, bitcask.WithEncryptionKey(key))
+	if err != nil {
+		log.Fatalf("failed to migrate store: %s", err)
+	}
+	log.Printf("migrated %d data files", n)
+}
+
+func syncPolicy(s string) (bitcask.SyncPolicy, error) {
+	switch s {
+	case "always":
+		return bitcask.SyncAlways, nil
+	case "never":
+		return bitcask.SyncNever, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return bitcask.SyncNever, err
+	}
+	if d <= 0 {
+		return bitcask.SyncNever, fmt.Errorf("interval %s must be positive", d)
+	}
+	return bitcask.SyncInterval(d), nil
+}
+
+// logStats logs the memory held by the keydir and the value cache
+// counters.
+func logStats(db *bitcask.Bitcask) {
+	m := db.KeyDirMemory()
+	log.Printf("keydir: %d keys, %d bytes (keys %d, arena %d, entries %d, table %d, index %d)",
+		m.Keys, m.Total(), m.KeyBytes, m.ArenaBytes, m.EntryBytes, m.TableBytes, m.IndexBytes)
+	c := db.CacheStats()
+	log.Printf("cache: %d values, %d bytes, %d hits, %d misses, %d evictions",
+		c.Entries, c.Bytes, c.Hits, c.Misses, c.Evictions)
+}
+
+// readKeyFile returns the hex encoded key stored in name, or nil when name
+// is empty.
+func readKeyFile(name string) ([]byte, error) {
+	if name == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,168 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// commitKeySize is the size of the operation count stored as the key of a
+// commit entry.
+const commitKeySize = 4
+
+var errUnterminatedBatch = errors.New("entry inside an unterminated batch")
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Batch collects puts and deletes that are applied atomically by Write.
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	ops []batchOp
+}
+
+// NewBatch returns an empty batch.
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put adds the key value pair to the batch.
+func (b *Batch) Put(key, value string) {
+	b.PutBytes([]byte(key), []byte(value))
+}
+
+// PutBytes adds the key value pair to the batch. The slices are copied.
+func (b *Batch) PutBytes(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:   append([]byte(nil), key...),
+		value: append([]byte{}, value...),
+	})
+}
+
+// Delete adds the deletion of key to the batch.
+func (b *Batch) Delete(key string) {
+	b.DeleteBytes([]byte(key))
+}
+
+// DeleteBytes adds the deletion of key to the batch. The slice is copied.
+func (b *Batch) DeleteBytes(key []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:    append([]byte(nil), key...),
+		value:  []byte{},
+		delete: true,
+	})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset removes all operations from the batch.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies the operations of the batch atomically. The entries are
+// appended with a single write followed by a commit entry; on load a batch
+// without its commit entry is discarded as a whole.
+func (db *Bitcask) Write(b *Batch) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	for _, op := range b.ops {
+		check := db.checkSize(op.key, op.value)
+		if op.delete {
+			check = db.checkKeySize(op.key)
+		}
+		if check != nil {
+			return check
+		}
+	}
+	return db.update(func() error {
+		return db.writeBatch(b)
+	})
+}
+
+// writeBatch logs the entries of b followed by the commit entry and then
+// applies them to the keydir. The caller must hold db.mu.
+func (db *Bitcask) writeBatch(b *Batch) error {
+	now := time.Now().UnixNano()
+	var es []*entry
+	groups := make([][]*entry, len(b.ops))
+	for i, op := range b.ops {
+		if op.delete {
+			groups[i] = []*entry{{
+				timestamp: now,
+				ksz:       uint32(len(op.key)),
+				flags:     flagVersion,
+				version:   db.nextVersion(),
+				key:       op.key,
+				value:     op.value,
+			}}
+		} else {
+			groups[i] = db.split(op.key, op.value, now, 0, db.nextVersion())
+		}
+		for _, e := range groups[i] {
+			e.flags |= flagBatch
+		}
+		es = append(es, groups[i]...)
+	}
+	count := make([]byte, commitKeySize)
+	binary.BigEndian.PutUint32(count, uint32(len(b.ops)))
+	commit := &entry{
+		timestamp: now,
+		ksz:       commitKeySize,
+		flags:     flagCommit,
+		key:       count,
+		value:     []byte{},
+	}
+	es = append(es, commit)
+
+	pos, err := db.log(es...)
+	if err != nil {
+		return err
+	}
+	kds := make([]keyDirEntry, len(b.ops))
+	hints := make([]*keyDirEntry, 0, len(b.ops)+1)
+	for i := range b.ops {
+		kds[i] = locate(db.activeFile.id, pos, groups[i])
+		kds[i].flags |= flagBatch
+		pos += kds[i].recordSize()
+		hints = append(hints, &kds[i])
+	}
+	kd := locate(db.activeFile.id, pos, []*entry{commit})
+	kd.flags |= flagCommit
+	hints = append(hints, &kd)
+	if err := db.hint(db.activeFile, hints...); err != nil {
+		return err
+	}
+
+	db.activeFile.stat.deadbytes += int(db.activeFile.offset - pos)
+	for i, op := range b.ops {
+		kds[i].flags &^= flagBatch
+		if op.delete {
+			db.activeFile.stat.deadbytes += int(kds[i].recordSize())
+			db.removeKey(string(op.key))
+			continue
+		}
+		db.setKey(kds[i])
+	}
+	db.activeFile.stat.update()
+	return nil
+}
+
+// checkCommit verifies that the commit entry with the given key closes a
+// batch of n entries.
+func checkCommit(key []byte, n int) error {
+	if len(key) != commitKeySize || binary.BigEndian.Uint32(key) != uint32(n) {
+		return errors.New("batch commit does not match its entries")
+	}
+	return nil
+}
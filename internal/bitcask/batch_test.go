@@ -0,0 +1,115 @@
+package bitcask
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithChunkSize(8), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("gone", "value")
+
+	b := NewBatch()
+	b.Put("a", "1")
+	b.Put("large", strings.Repeat("x", 30))
+	b.Delete("gone")
+	b.Put("a", "2")
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	expected := map[string]string{"a": "2", "large": strings.Repeat("x", 30)}
+	check := func(db *Bitcask) {
+		for k, v := range expected {
+			if _, got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("expected %v but got %v (%v)", v, got, err)
+			}
+		}
+		if db.HasKey("gone") {
+			t.Errorf("expected deleted key to be missing")
+		}
+	}
+	check(db)
+	db.Close()
+
+	db, err = Open(dir, WithChunkSize(8), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	check(db)
+	db.Close()
+
+	for _, name := range dataFileNames(dir) {
+		os.Remove(name + ".hint")
+	}
+	db, err = Open(dir, WithChunkSize(8), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	check(db)
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Close()
+
+	for _, name := range dataFileNames(dir) {
+		os.Remove(name + ".hint")
+	}
+	db, err = Open(dir, WithChunkSize(8), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestWriteBatchTorn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "1")
+	b := NewBatch()
+	b.Put("a", "2")
+	b.Put("b", "2")
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Close()
+
+	// Drop the commit entry as if the write had been interrupted.
+	names := dataFileNames(dir)
+	last := names[len(names)-1]
+	data, _ := ioutil.ReadFile(last)
+	ioutil.WriteFile(last, data[:len(data)-currentFormat.headerSize()-commitKeySize], 0644)
+	os.Remove(last + ".hint")
+
+	db, err = Open(dir, WithRecovery(true))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	if _, got, _ := db.Get("a"); got != "1" {
+		t.Errorf("expected %v but got %v", "1", got)
+	}
+	if db.HasKey("b") {
+		t.Errorf("expected uncommitted key to be missing")
+	}
+}
@@ -4,31 +4,99 @@ package bitcask
 import (
 	"bufio"
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofrs/flock"
 )
 
-const headerSize = 16
+const (
+	expirySize  = 4
+	versionSize = 8
+)
+
+// Entry flags are stored in the most significant byte of the key size.
+const (
+	// flagChunk marks an entry holding one part of a value that was split
+	// across consecutive entries of the same data file.
+	flagChunk uint8 = 1 << iota
+	// flagLastChunk marks the final part of a chunked value.
+	flagLastChunk
+	// flagExpiry marks an entry whose header carries an expiry timestamp
+	// after the value size.
+	flagExpiry
+	// flagBatch marks an entry written by a batch. It only takes effect
+	// once the commit entry of the batch is read.
+	flagBatch
+	// flagCommit marks the entry closing a batch. Its key holds the number
+	// of operations in the batch.
+	flagCommit
+	// flagVersion marks an entry whose header carries the version of its
+	// key after the expiry.
+	flagVersion
+	// flagCompressed marks a value stored deflated. For a chunked value
+	// every chunk holds a part of the deflated value.
+	flagCompressed
+	// flagEncrypted marks an entry whose key and value are sealed with
+	// AES-GCM. The nonce follows the header and the tag, which takes the
+	// place of the checksum, follows the value. The header is authenticated.
+	flagEncrypted
+)
+
+// valueFlags are the entry flags the keydir keeps to locate and read a
+// value.
+const valueFlags = flagExpiry | flagVersion | flagCompressed | flagEncrypted
 
 const (
-	threshold          = 8 * 1_000_000
-	maxKsz             = 1024
-	maxVsz             = 2048
-	fragmentation      = 20
-	deadBytesThreshold = threshold / 4
-	dirThreshold       = threshold * 8
+	flagShift = 24
+	kszMask   = 1<<flagShift - 1
+)
+
+var (
+	// ErrKeyTooLarge is returned when a key exceeds the configured maximum size.
+	ErrKeyTooLarge = errors.New("key exceeds allowed size")
+	// ErrValueTooLarge is returned when a value exceeds the configured maximum size.
+	ErrValueTooLarge = errors.New("value exceeds allowed size")
+	// ErrEmptyValue is returned when a key is written with an empty value,
+	// which the data files cannot tell from a deletion.
+	ErrEmptyValue = errors.New("value is empty")
+	// ErrInvalidTTL is returned when a key is written with a non-positive TTL.
+	ErrInvalidTTL = errors.New("ttl must be positive")
+	// ErrConditionFailed is returned by a conditional write when the
+	// current value or version of the key does not match.
+	ErrConditionFailed = errors.New("condition failed")
+	// ErrReadOnly is returned by the writes of a datastore opened with
+	// OpenReadOnly.
+	ErrReadOnly = errors.New("datastore is read only")
+	// ErrCorrupt is returned by Open when a data or hint file cannot be
+	// decoded. Opening with WithRecovery repairs the store.
+	ErrCorrupt = errors.New("corrupt data file")
+)
+
+const (
+	threshold            = 8 * 1_000_000
+	maxKsz               = 1024
+	maxVsz               = 64 * 1_000_000
+	chunkSize            = 64 * 1024
+	compressionThreshold = 256
+	sweepInterval        = time.Minute
+	mergeInterval        = 10 * time.Minute
+	checkpointInterval   = 5 * time.Minute
+	fragmentation        = 20
+	deadBytesThreshold   = threshold / 4
+	dirThreshold         = threshold * 8
 )
 
 type status struct {
@@ -36,228 +104,617 @@ type status struct {
 	fragmented   int
 	deadbytes    int
 	totalbytes   int
-	oldestTstamp int
-	newestTstamp int
+	oldestTstamp int64
+	newestTstamp int64
 }
 
+// entry is a record of a data file. The timestamp is in nanoseconds.
 type entry struct {
 	crc       uint32
-	timestamp uint32
+	timestamp int64
 	ksz       uint32
 	vsz       uint32
+	flags     uint8
+	expiry    uint32
+	version   uint64
 	key       []byte
 	value     []byte
 }
 
-func encode(buff *bytes.Buffer, e *entry) (int, error) {
-	if e.ksz > maxKsz || e.vsz > maxVsz {
+// encode appends e to buff in format f, sealing its key and value when
+// aead is not nil. The AEAD tag then authenticates the record in place of
+// the crc, whose field is kept and written as zero: the flags marking a
+// record as encrypted follow it, so every record must share the offsets of
+// the fixed header for readers to find its flags and sizes.
+func encode(buff *bytes.Buffer, e *entry, f format, aead cipher.AEAD) (int, error) {
+	if e.ksz > kszMask {
 		return 0, errors.New("data exceeds allowed size")
 	}
+	if aead != nil {
+		e.flags |= flagEncrypted
+	} else {
+		e.flags &^= flagEncrypted
+	}
 	var d bytes.Buffer
-	binary.Write(&d, binary.BigEndian, e.timestamp)
-	binary.Write(&d, binary.BigEndian, e.ksz)
+	f.writeTimestamp(&d, e.timestamp)
+	binary.Write(&d, binary.BigEndian, uint32(e.flags)<<flagShift|e.ksz)
 	binary.Write(&d, binary.BigEndian, e.vsz)
-	binary.Write(&d, binary.BigEndian, e.key)
-	binary.Write(&d, binary.BigEndian, e.value)
-	e.crc = crc32.ChecksumIEEE(d.Bytes())
+	if e.flags&flagExpiry != 0 {
+		binary.Write(&d, binary.BigEndian, e.expiry)
+	}
+	if e.flags&flagVersion != 0 {
+		binary.Write(&d, binary.BigEndian, e.version)
+	}
+	if aead != nil {
+		header := append([]byte(nil), d.Bytes()...)
+		plaintext := make([]byte, 0, len(e.key)+len(e.value))
+		plaintext = append(append(plaintext, e.key...), e.value...)
+		if err := seal(&d, aead, header, plaintext); err != nil {
+			return 0, err
+		}
+		e.crc = 0
+	} else {
+		binary.Write(&d, binary.BigEndian, e.key)
+		binary.Write(&d, binary.BigEndian, e.value)
+		e.crc = crc32.ChecksumIEEE(d.Bytes())
+	}
 	binary.Write(buff, binary.BigEndian, e.crc)
 	d.WriteTo(buff)
 	d.Reset()
 	return buff.Len(), nil
 }
 
-func decode(buff *bytes.Buffer, e *entry) error {
+// decode reads the entry in format f at the start of buff into e, opening
+// it with aead when it is encrypted.
+func decode(buff *bytes.Buffer, e *entry, f format, aead cipher.AEAD) error {
 	d := buff.Bytes()
+	if len(d) < f.headerSize() {
+		return io.ErrUnexpectedEOF
+	}
 	binary.Read(buff, binary.BigEndian, &e.crc)
-	binary.Read(buff, binary.BigEndian, &e.timestamp)
+	e.timestamp, _ = f.readTimestamp(buff)
 	binary.Read(buff, binary.BigEndian, &e.ksz)
 	binary.Read(buff, binary.BigEndian, &e.vsz)
+	e.flags = uint8(e.ksz >> flagShift)
+	e.ksz &= kszMask
+	if e.flags&flagExpiry != 0 {
+		if err := binary.Read(buff, binary.BigEndian, &e.expiry); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	if e.flags&flagVersion != 0 {
+		if err := binary.Read(buff, binary.BigEndian, &e.version); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	if e.flags&flagEncrypted != 0 {
+		// The crc field is not covered by the tag, so it must be zero.
+		if e.crc != 0 {
+			return errors.New("Checksum error reading entry")
+		}
+		header := d[4 : f.headerLen(e.flags)-nonceSize]
+		plain, err := unseal(buff, aead, header, int(e.ksz)+int(e.vsz))
+		if err != nil {
+			return err
+		}
+		e.key, e.value = plain[:e.ksz], plain[e.ksz:]
+		return nil
+	}
 
-	if e.ksz > maxKsz || e.vsz > maxVsz {
-		return errors.New("data exceeds allowed size")
+	if int(e.ksz)+int(e.vsz) > buff.Len() {
+		return io.ErrUnexpectedEOF
 	}
 
 	e.key = make([]byte, e.ksz)
 	e.value = make([]byte, e.vsz)
 	binary.Read(buff, binary.BigEndian, e.key[:])
 	binary.Read(buff, binary.BigEndian, e.value[:])
-	if e.crc != crc32.ChecksumIEEE(d[4:]) {
+	if e.crc != crc32.ChecksumIEEE(d[4:f.headerLen(e.flags)+int(e.ksz+e.vsz)]) {
 		return errors.New("Checksum error reading entry")
 	}
 	return nil
 }
 
+// keyDirEntry locates the latest value of a key. For chunked values
+// valuePos and valueSz cover the whole chain of entries instead of the
+// value bytes. format is the format of the file holding the entries.
 type keyDirEntry struct {
 	fileID    int64
 	valueSz   uint32
 	valuePos  int64
-	timestamp uint32
+	timestamp int64
+	flags     uint8
+	format    format
+	expiry    uint32
+	version   uint64
 	key       []byte
 }
 
-func encodeKeyEntry(buf *bytes.Buffer, e *keyDirEntry) (int, error) {
-	binary.Write(buf, binary.BigEndian, e.timestamp)
-	binary.Write(buf, binary.BigEndian, uint32(len(e.key)))
-	binary.Write(buf, binary.BigEndian, e.valueSz)
-	binary.Write(buf, binary.BigEndian, e.valuePos)
-	binary.Write(buf, binary.BigEndian, e.key)
+// recordPos returns the offset of the data file entries backing e.
+func (e *keyDirEntry) recordPos() int64 {
+	if e.flags&flagChunk != 0 {
+		return e.valuePos
+	}
+	return e.valuePos - int64(e.format.headerLen(e.flags)+len(e.key))
+}
+
+// recordSize returns the size of the data file entries backing e.
+func (e *keyDirEntry) recordSize() int64 {
+	if e.flags&flagChunk != 0 {
+		return int64(e.valueSz)
+	}
+	return e.format.recordLen(e.flags, uint32(len(e.key)), e.valueSz)
+}
+
+// tombstone returns true if e records the deletion of its key. Writes
+// reject empty values, so only a tombstone has none.
+func (e *keyDirEntry) tombstone() bool {
+	return e.valueSz == 0 && e.flags&flagChunk == 0
+}
+
+// sameRecord returns true if e and o locate the same version of a key in
+// the same place.
+func (e *keyDirEntry) sameRecord(o *keyDirEntry) bool {
+	return e.fileID == o.fileID && e.valuePos == o.valuePos && e.version == o.version
+}
+
+// expired returns true if e has an expiry that is not after now.
+func (e *keyDirEntry) expired(now uint32) bool {
+	return e.flags&flagExpiry != 0 && e.expiry <= now
+}
+
+// encodeKeyEntry appends the hint record of e to buf in the format of e.
+// The key of an entry backed by an encrypted record is sealed with aead as
+// well.
+func encodeKeyEntry(buf *bytes.Buffer, e *keyDirEntry, aead cipher.AEAD) (int, error) {
+	var d bytes.Buffer
+	e.format.writeTimestamp(&d, e.timestamp)
+	binary.Write(&d, binary.BigEndian, uint32(e.flags)<<flagShift|uint32(len(e.key)))
+	binary.Write(&d, binary.BigEndian, e.valueSz)
+	binary.Write(&d, binary.BigEndian, e.valuePos)
+	if e.flags&flagExpiry != 0 {
+		binary.Write(&d, binary.BigEndian, e.expiry)
+	}
+	if e.flags&flagVersion != 0 {
+		binary.Write(&d, binary.BigEndian, e.version)
+	}
+	if e.flags&flagEncrypted != 0 {
+		if aead == nil {
+			return 0, errors.New("encrypted entry without a key")
+		}
+		header := append([]byte(nil), d.Bytes()...)
+		if err := seal(&d, aead, header, e.key); err != nil {
+			return 0, err
+		}
+	} else {
+		binary.Write(&d, binary.BigEndian, e.key)
+	}
+	d.WriteTo(buf)
 	return buf.Len(), nil
 }
 
-func decodeKeyEntry(buff *bytes.Buffer, e *keyDirEntry) (int, error) {
+// decodeKeyEntry reads the hint record at the start of buff into e, in
+// the format of e.
+func decodeKeyEntry(buff *bytes.Buffer, e *keyDirEntry, aead cipher.AEAD) (int, error) {
+	d := buff.Bytes()
 	var ks uint32
-	binary.Read(buff, binary.BigEndian, &e.timestamp)
+	if buff.Len() < e.format.hintHeaderSize() {
+		return buff.Len(), io.ErrUnexpectedEOF
+	}
+	e.timestamp, _ = e.format.readTimestamp(buff)
 	binary.Read(buff, binary.BigEndian, &ks)
 	binary.Read(buff, binary.BigEndian, &e.valueSz)
 	binary.Read(buff, binary.BigEndian, &e.valuePos)
+	e.flags = uint8(ks >> flagShift)
+	ks &= kszMask
+	if e.flags&flagExpiry != 0 {
+		if err := binary.Read(buff, binary.BigEndian, &e.expiry); err != nil {
+			return buff.Len(), io.ErrUnexpectedEOF
+		}
+	}
+	if e.flags&flagVersion != 0 {
+		if err := binary.Read(buff, binary.BigEndian, &e.version); err != nil {
+			return buff.Len(), io.ErrUnexpectedEOF
+		}
+	}
+	if e.flags&flagEncrypted != 0 {
+		header := d[:len(d)-buff.Len()]
+		key, err := unseal(buff, aead, header, int(ks))
+		if err != nil {
+			return buff.Len(), err
+		}
+		e.key = key
+		return buff.Len(), nil
+	}
 
+	if int(ks) > buff.Len() {
+		return buff.Len(), io.ErrUnexpectedEOF
+	}
 	e.key = make([]byte, ks)
 	binary.Read(buff, binary.BigEndian, e.key[:])
 	return buff.Len(), nil
 }
 
+// dataFileIter reads the entries of a data file in order up to the offset
+// the file had when the iterator was created. It reads through its own
+// file handle, so it keeps working after the file is merged away.
 type dataFileIter struct {
-	begin   int
-	end     int
-	len     int
-	curr    int
+	aead    cipher.AEAD
+	end     int64
+	curr    int64
 	dfile   *dataFile
+	file    *os.File
 	freader *bufio.Reader
 }
 
-func newDataFileIter(df *dataFile) (*dataFileIter, error) {
-	i, _ := df.r.Stat()
-	s := int(i.Size())
+func newDataFileIter(df *dataFile, aead cipher.AEAD) (*dataFileIter, error) {
 	f, err := os.Open(df.name)
 	if err != nil {
 		return nil, err
 	}
-	reader := bufio.NewReaderSize(f, s)
+	if _, err := f.Seek(df.format.fileHeaderLen(), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
 	return &dataFileIter{
-		begin:   0,
-		end:     s,
-		len:     s,
-		curr:    0,
+		aead:    aead,
+		end:     df.offset,
+		curr:    df.format.fileHeaderLen(),
 		dfile:   df,
-		freader: reader,
+		file:    f,
+		freader: bufio.NewReader(f),
 	}, nil
 }
 
+// load replays the data files listed in the manifest in the order they
+// were written, so that the last entry of a key, value or tombstone, wins.
+// When the keydir checkpoint covers the first files, it starts from the
+// checkpoint and replays only what was written after it.
 func (db *Bitcask) load() error {
-	logFiles, err := ioutil.ReadDir(db.directory)
+	m, err := readManifest(db.directory)
 	if err != nil {
 		return err
 	}
-	for _, fi := range logFiles {
-		if filepath.Ext(fi.Name()) != ".data" {
-			continue
+	atomic.StoreInt64(&db.nextFileID, m.next)
+	now := unixNow()
+	var covered []int64
+	if !db.config.recovery {
+		covered = db.loadCheckpoint(m, now)
+	}
+	var jobs []loadJob
+	for i, mf := range m.files {
+		newest := i == len(m.files)-1
+		df, err := db.openDataFile(mf.id, mf.hint)
+		if os.IsNotExist(err) {
+			if newest {
+				// The newest file is listed before it is created.
+				break
+			}
+			if db.readOnly && manifestChanged(db.directory, m) {
+				return errManifestChanged
+			}
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
 		}
-		df, err := db.openDataFile(fi.Name())
 		if err != nil {
 			return err
 		}
-		db.dataFiles[df.id] = df
-		if df.hr != nil {
-			buffer := db.bufferPool.Get().(*bytes.Buffer)
-			buffer.ReadFrom(df.hr)
-			for buffer.Len() != 0 {
-				ke := keyDirEntry{
-					fileID: df.id,
-				}
-				decodeKeyEntry(buffer, &ke)
-				if ke.valueSz != 0 {
-					db.keyDir[string(ke.key)] = ke
-				}
+		if db.config.recovery {
+			if err := db.recoverDataFile(df, newest, now); err != nil {
+				return err
 			}
-			df.hr.Close()
-			buffer.Reset()
-			db.bufferPool.Put(buffer)
-		} else {
-			buffer := db.bufferPool.Get().(*bytes.Buffer)
-			buffer.ReadFrom(df.r)
-			size := buffer.Len()
-			for buffer.Len() != 0 {
-				offset := buffer.Len()
-				e := entry{}
-				decode(buffer, &e)
-				if e.vsz == 0 {
-					continue
-				}
-				ke := keyDirEntry{
-					fileID:    df.id,
-					valueSz:   uint32(len(e.value)),
-					valuePos:  int64(size - offset),
-					timestamp: e.timestamp,
-					key:       []byte(e.key),
-				}
-				db.keyDir[string(ke.key)] = ke
-			}
-			buffer.Reset()
-			db.bufferPool.Put(buffer)
+			continue
+		}
+		db.dataFiles[df.id] = df
+		db.order = append(db.order, df.id)
+		start := df.format.fileHeaderLen()
+		if i < len(covered) {
+			start = covered[i]
+		}
+		// A writer may still be appending to the newest file, so a
+		// reader skips its hint file and ignores a torn tail.
+		jobs = append(jobs, loadJob{df: df, start: start, tail: db.readOnly && newest})
+	}
+	if err := db.loadFiles(jobs, now); err != nil {
+		return err
+	}
+	if m.version > db.version {
+		db.version = m.version
+	}
+	for i, id := range db.order {
+		// A reader may see the newest file grow.
+		if !db.readOnly || i < len(db.order)-1 {
+			db.mapDataFile(db.dataFiles[id])
 		}
 	}
 	return nil
 }
 
-func (db *Bitcask) openDataFile(f string) (*dataFile, error) {
-	id := f[:strings.LastIndex(f, ".bitcask.data")]
-	i, err := strconv.Atoi(id)
+// replay applies the entries read from a data or hint file to the keydir.
+func (db *Bitcask) replay(entries []keyDirEntry, now uint32) {
+	for _, ke := range entries {
+		if ke.version > db.version {
+			db.version = ke.version
+		}
+		if ke.tombstone() || ke.expired(now) {
+			db.removeKey(string(ke.key))
+		} else {
+			db.setKey(ke)
+		}
+	}
+}
+
+// readHintFile returns the keydir entries recorded in the hint file of df.
+func (db *Bitcask) readHintFile(df *dataFile) ([]keyDirEntry, error) {
+	buffer := db.bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		buffer.Reset()
+		db.bufferPool.Put(buffer)
+	}()
+	start := df.format.fileHeaderLen()
+	if start > 0 {
+		f, err := readFileHeader(df.hr, df.id, fileHint)
+		if err != nil {
+			return nil, err
+		}
+		if f != df.format {
+			return nil, errors.New("hint file format does not match its data file")
+		}
+	}
+	fi, err := df.hr.Stat()
 	if err != nil {
 		return nil, err
 	}
+	rr := newRecordReader(io.NewSectionReader(df.hr, start, fi.Size()-start), fi.Size()-start, df.format, true)
+	var entries, batch []keyDirEntry
+	inBatch := false
+	for {
+		_, err := rr.next(buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ke := keyDirEntry{
+			fileID: df.id,
+			format: df.format,
+		}
+		if _, err := decodeKeyEntry(buffer, &ke, db.aead); err != nil {
+			return nil, err
+		}
+		if ke.recordPos() < start || ke.recordPos()+ke.recordSize() > df.offset {
+			return nil, errors.New("hint points outside the data file")
+		}
+		switch {
+		case ke.flags&flagCommit != 0:
+			if err := checkCommit(ke.key, len(batch)); err != nil {
+				return nil, err
+			}
+			entries = append(entries, batch...)
+			batch, inBatch = batch[:0], false
+		case ke.flags&flagBatch != 0:
+			ke.flags &^= flagBatch
+			batch, inBatch = append(batch, ke), true
+		case inBatch:
+			return nil, errUnterminatedBatch
+		default:
+			entries = append(entries, ke)
+		}
+	}
+	if inBatch {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return entries, nil
+}
+
+// readDataFile returns the keydir entries of the records in df from
+// start, which is the end of the file header or of an earlier record. It
+// stops at the first record that cannot be decoded and returns the size of
+// the valid prefix of the file together with the error.
+func (db *Bitcask) readDataFile(df *dataFile, start int64) ([]keyDirEntry, int64, error) {
+	buffer := db.bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		buffer.Reset()
+		db.bufferPool.Put(buffer)
+	}()
+	rr := newRecordReader(io.NewSectionReader(df.r, start, df.offset-start), df.offset-start, df.format, false)
+	var entries, batch []keyDirEntry
+	valid, end := start, start
+	chain, chainKey := int64(-1), []byte(nil)
+	inBatch := false
+	for {
+		n, err := rr.next(buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, valid, err
+		}
+		pos := end
+		end += n
+		e := entry{}
+		if err := decode(buffer, &e, df.format, db.aead); err != nil {
+			return entries, valid, err
+		}
+		if e.flags&flagCommit != 0 {
+			if err := checkCommit(e.key, len(batch)); err != nil {
+				return entries, valid, err
+			}
+			entries = append(entries, batch...)
+			batch, inBatch, valid = batch[:0], false, end
+			continue
+		}
+		if inBatch && e.flags&flagBatch == 0 {
+			return entries, valid, errUnterminatedBatch
+		}
+		ke := keyDirEntry{
+			fileID:    df.id,
+			valueSz:   uint32(len(e.value)),
+			valuePos:  pos + int64(df.format.headerLen(e.flags)+int(e.ksz)),
+			timestamp: e.timestamp,
+			flags:     e.flags & valueFlags,
+			format:    df.format,
+			expiry:    e.expiry,
+			version:   e.version,
+			key:       e.key,
+		}
+		if e.flags&flagChunk != 0 {
+			if chain < 0 || !bytes.Equal(chainKey, e.key) {
+				chain, chainKey = pos, e.key
+			}
+			if e.flags&flagLastChunk == 0 {
+				continue
+			}
+			ke.valueSz = uint32(end - chain)
+			ke.valuePos = chain
+			ke.flags |= flagChunk
+		}
+		chain = -1
+		if e.flags&flagBatch != 0 {
+			batch, inBatch = append(batch, ke), true
+			continue
+		}
+		entries, valid = append(entries, ke), end
+	}
+	if chain >= 0 || inBatch {
+		return entries, valid, io.ErrUnexpectedEOF
+	}
+	return entries, valid, nil
+}
+
+func parseFileID(f string) (int64, error) {
+	return strconv.ParseInt(f[:strings.LastIndex(f, ".bitcask.data")], 10, 64)
+}
+
+// openDataFile opens the data file with the given id, and its hint file
+// when the manifest records one.
+func (db *Bitcask) openDataFile(id int64, hint bool) (*dataFile, error) {
 	df := &dataFile{
-		name:   f,
-		id:     int64(i),
+		name:   dataFilePath(db.directory, id),
+		id:     id,
 		offset: 0,
 	}
-	log, err := os.Open(filepath.Join(db.directory, f))
+	log, err := os.Open(df.name)
 	if err != nil {
 		return nil, err
 	}
-	hintPath := filepath.Join(db.directory, f+".hint")
-	if _, err := os.Stat(hintPath); err == nil {
-		hint, err := os.Open(filepath.Join(db.directory, f+".hint"))
-		if err != nil {
+	fi, err := log.Stat()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	df.offset = fi.Size()
+	df.stat = status{
+		filename:   df.name,
+		totalbytes: int(fi.Size()),
+	}
+	if df.format, err = readFileHeader(log, id, 0); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if hint {
+		hr, err := os.Open(df.name + ".hint")
+		if err != nil && !os.IsNotExist(err) {
+			log.Close()
 			return nil, err
 		}
-		df.hr = hint
+		if err == nil {
+			df.hr, df.hint = hr, true
+		}
 	}
 	df.r = log
 	return df, nil
 }
 
 func (df *dataFileIter) HasNext() bool {
-	return df.curr < df.len
+	return df.curr < df.end
+}
+
+// Next returns the next entry as the keydir would locate it, together
+// with its value. The parts of a chunked value are joined into one entry.
+func (df *dataFileIter) Next() (*keyDirEntry, []byte, error) {
+	start := df.curr
+	var value []byte
+	for {
+		pos := df.curr
+		e, err := df.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		kd := &keyDirEntry{
+			fileID:    df.dfile.id,
+			valueSz:   e.vsz,
+			valuePos:  pos + int64(df.dfile.format.headerLen(e.flags)+int(e.ksz)),
+			timestamp: e.timestamp,
+			flags:     e.flags &^ (flagChunk | flagLastChunk | flagBatch),
+			format:    df.dfile.format,
+			expiry:    e.expiry,
+			version:   e.version,
+			key:       e.key,
+		}
+		value = append(value, e.value...)
+		if e.flags&flagChunk == 0 || e.flags&flagLastChunk != 0 {
+			if e.flags&flagChunk != 0 {
+				kd.flags |= flagChunk
+				kd.valueSz = uint32(df.curr - start)
+				kd.valuePos = start
+			}
+			if kd.flags&flagCompressed != 0 {
+				if value, err = decompress(value); err != nil {
+					return nil, nil, err
+				}
+			}
+			return kd, value, nil
+		}
+	}
 }
 
-func (df *dataFileIter) Next() (string, *keyDirEntry) {
-	header := make([]byte, headerSize)
-	i, err := df.freader.Read(header)
+// read decodes the entry at the current offset.
+func (df *dataFileIter) read() (*entry, error) {
+	if df.curr >= df.end {
+		return nil, io.ErrUnexpectedEOF
+	}
+	f := df.dfile.format
+	header, err := df.freader.Peek(f.headerSize())
 	if err != nil {
+		return nil, err
+	}
+	sizes := header[4+f.timestampSize():]
+	ksz := binary.BigEndian.Uint32(sizes[0:4])
+	vsz := binary.BigEndian.Uint32(sizes[4:8])
+	n := f.recordLen(uint8(ksz>>flagShift), ksz&kszMask, vsz)
+	if df.curr+n > df.end {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(df.freader, buf); err != nil {
+		return nil, err
 	}
-	kd := &keyDirEntry{
-		fileID: df.dfile.id,
+	e := &entry{}
+	if err := decode(bytes.NewBuffer(buf), e, f, df.aead); err != nil {
+		return nil, err
 	}
-	t := binary.BigEndian.Uint32(header[4:8])
-	ksz := binary.BigEndian.Uint32(header[8:12])
-	vsz := binary.BigEndian.Uint32(header[12:16])
-	key := make([]byte, ksz)
-	i, _ = df.freader.Read(key)
-	i, _ = df.freader.Discard(int(vsz))
-	kd.valueSz = vsz
-	kd.timestamp = t
-	df.curr = i
-	return string(key), kd
+	df.curr += n
+	return e, nil
+}
+
+func (df *dataFileIter) Close() error {
+	return df.file.Close()
 }
 
 type dataFile struct {
 	name   string
 	id     int64
+	format format
+	hint   bool
 	offset int64
 	w      *os.File
 	r      *os.File
 	hw     *os.File
 	hr     *os.File
+	// data maps the file once it is immutable, see WithMmap.
+	data []byte
+	stat status
 }
 
 // Bitcask Log-Structured Hash Table
@@ -265,34 +722,75 @@ type Bitcask struct {
 	mu         sync.RWMutex
 	fileLock   *flock.Flock
 	mergeLock  *flock.Flock
+	mergeMu    sync.Mutex
 	directory  string
+	config     *config
 	activeFile *dataFile
-	keyDir     map[string]keyDirEntry
+	keyDir     *keyDir
+	index      *skiplist
 	bufferPool sync.Pool
 	dataFiles  map[int64]*dataFile
+	order      []int64
+	nextFileID int64
+	version    uint64
+	expiring   int
+	recovery   Recovery
+	readOnly   bool
+	aead       cipher.AEAD
+	group      *groupCommit
+	cache      *valueCache
+	done       chan struct{}
+	mergeCh    chan struct{}
+	wg         sync.WaitGroup
+	closeOnce  sync.Once
 }
 
-type config struct {
-	threshold int
-}
-
-// Open a new or existing Bitcask datastore
-func Open(path string) (*Bitcask, error) {
-	if _, err := os.Stat(path); !os.IsExist(err) {
-		os.MkdirAll(path, 0755)
+func newBitcask(path string, cfg *config) (*Bitcask, error) {
+	var aead cipher.AEAD
+	if cfg.encryptionKey != nil {
+		var err error
+		if aead, err = newAEAD(cfg.encryptionKey); err != nil {
+			return nil, err
+		}
 	}
-
-	db := &Bitcask{
+	dir := newKeyDir()
+	return &Bitcask{
 		directory: path,
+		config:    cfg,
 		fileLock:  flock.New(filepath.Join(path, ".bitcask.write.lock")),
 		mergeLock: flock.New(filepath.Join(path, ".bitcask.merge.lock")),
-		keyDir:    make(map[string]keyDirEntry),
+		keyDir:    dir,
+		index:     newSkiplist(dir),
 		dataFiles: make(map[int64]*dataFile),
+		done:      make(chan struct{}),
+		mergeCh:   make(chan struct{}, 1),
+		group:     newGroupCommit(),
+		cache:     newValueCache(cfg.cacheSize),
+		aead:      aead,
 		bufferPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
 			},
 		},
+	}, nil
+}
+
+// Open a new or existing Bitcask datastore
+func Open(path string, opts ...Option) (*Bitcask, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, cfg.dirPerm); err != nil {
+		return nil, err
+	}
+
+	db, err := newBitcask(path, cfg)
+	if err != nil {
+		return nil, err
 	}
 	locked, err := db.fileLock.TryLock()
 	if err != nil {
@@ -301,16 +799,113 @@ func Open(path string) (*Bitcask, error) {
 	if !locked {
 		return nil, errors.New("Database is locked")
 	}
-	db.load()
-	db.activeFile, _ = newDataFile(path)
+	rotating, err := checkKey(path, db.aead, cfg.filePerm, false)
+	if err != nil {
+		db.fileLock.Unlock()
+		return nil, err
+	}
+	if err := db.load(); err != nil {
+		db.closeDataFiles()
+		db.fileLock.Unlock()
+		return nil, err
+	}
+	if rotating {
+		// The data files were read with the key, which settles the
+		// switch of an unfinished RotateKey in its favour.
+		if err := writeKeyCheck(path, cfg.filePerm, db.aead); err != nil {
+			db.closeDataFiles()
+			db.fileLock.Unlock()
+			return nil, err
+		}
+	}
+	if err := db.removeUnlisted(); err != nil {
+		db.closeDataFiles()
+		db.fileLock.Unlock()
+		return nil, err
+	}
+	db.computeStats()
+	db.activeFile, err = db.newDataFile()
+	if err != nil {
+		db.fileLock.Unlock()
+		return nil, err
+	}
+	if cfg.sweepInterval > 0 {
+		db.wg.Add(1)
+		go db.sweeper(cfg.sweepInterval)
+	}
+	if cfg.sync.interval > 0 {
+		db.wg.Add(1)
+		go db.syncer(cfg.sync.interval)
+	}
+	if cfg.checkpointInterval > 0 {
+		db.wg.Add(1)
+		go db.checkpointer(cfg.checkpointInterval)
+	}
+	if cfg.autoMerge {
+		db.wg.Add(1)
+		go db.merger(cfg.mergeInterval)
+		for _, df := range db.dataFiles {
+			if df != db.activeFile && db.mergeNeeded(df) {
+				db.scheduleMerge()
+				break
+			}
+		}
+	}
 	return db, nil
 }
 
-// HasKey return true if key exist.
+// setKey records kd as the latest entry of its key. The caller must hold
+// db.mu.
+func (db *Bitcask) setKey(kd keyDirEntry) {
+	k := string(kd.key)
+	if old, ent, ok := db.keyDir.put(kd); ok {
+		if old.flags&flagExpiry != 0 {
+			db.expiring--
+		}
+		db.markDead(&old)
+	} else {
+		db.index.insert(k, ent)
+	}
+	if kd.flags&flagExpiry != 0 {
+		db.expiring++
+	}
+	db.cache.invalidate(k)
+}
+
+// removeKey drops key from the keydir. The caller must hold db.mu.
+func (db *Bitcask) removeKey(key string) {
+	if _, ok := db.keyDir.get(key); !ok {
+		return
+	}
+	db.index.remove(key)
+	old, _ := db.keyDir.remove(key)
+	if old.flags&flagExpiry != 0 {
+		db.expiring--
+	}
+	db.markDead(&old)
+	db.cache.invalidate(key)
+}
+
+// lookup returns the keydir entry of key unless it has expired. The
+// caller must hold db.mu.
+func (db *Bitcask) lookup(key string) (keyDirEntry, bool) {
+	kd, ok := db.keyDir.get(key)
+	if !ok || kd.expired(unixNow()) {
+		return keyDirEntry{}, false
+	}
+	return kd, true
+}
+
+// HasKey reports whether key exists.
 func (db *Bitcask) HasKey(key string) bool {
+	return db.HasKeyBytes([]byte(key))
+}
+
+// HasKeyBytes reports whether key exists.
+func (db *Bitcask) HasKeyBytes(key []byte) bool {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	_, ok := db.keyDir[key]
+	_, ok := db.lookup(string(key))
 	return ok
 }
 
@@ -318,158 +913,303 @@ func (db *Bitcask) HasKey(key string) bool {
 func (db *Bitcask) Keys() []string {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	ks := make([]string, 0, len(db.keyDir))
-	for k := range db.keyDir {
-		ks = append(ks, k)
+	now := unixNow()
+	ks := make([]string, 0, db.keyDir.len())
+	for n := db.index.seek(""); n != skipEnd; n = db.index.next(n) {
+		if kd := db.keyDir.at(n); !kd.expired(now) {
+			ks = append(ks, string(kd.key))
+		}
+	}
+	return ks
+}
+
+// KeysBytes returns a list with the existing keys. The returned slices
+// must not be modified.
+func (db *Bitcask) KeysBytes() [][]byte {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	now := unixNow()
+	ks := make([][]byte, 0, db.keyDir.len())
+	for n := db.index.seek(""); n != skipEnd; n = db.index.next(n) {
+		if kd := db.keyDir.at(n); !kd.expired(now) {
+			ks = append(ks, kd.key)
+		}
 	}
 	return ks
 }
 
 // Put adds a key value to the database
 func (db *Bitcask) Put(key, value string) error {
-	valueSz := uint32(len(value))
-	e := entry{
-		timestamp: uint32(time.Now().Unix()),
-		ksz:       uint32(len(key)),
-		vsz:       valueSz,
-		key:       []byte(key),
-		value:     []byte(value),
-	}
-	db.log(&e)
+	return db.PutBytes([]byte(key), []byte(value))
+}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if _, ok := db.dataFiles[db.activeFile.id]; !ok {
-		db.dataFiles[db.activeFile.id] = db.activeFile
-	}
-	kd := keyDirEntry{
-		fileID:    db.activeFile.id,
-		valueSz:   uint32(len(value)),
-		valuePos:  db.activeFile.offset - int64(valueSz),
-		timestamp: e.timestamp,
-		key:       []byte(key),
-	}
-	db.hint(&kd)
-	db.keyDir[key] = kd
-	return nil
+// PutBytes adds a key value to the database. The slices are not retained.
+func (db *Bitcask) PutBytes(key, value []byte) error {
+	return db.put(key, value, 0)
 }
 
-// Merge compacts the logs.
-func (db *Bitcask) Merge() error {
-	locked, err := db.mergeLock.TryLock()
-	if err != nil {
-		return err
+// put writes key with an optional expiry, zero meaning no expiry.
+func (db *Bitcask) put(key, value []byte, expiry uint32) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
-	if !locked {
-		return errors.New("Database is locked for merging")
+	if err := db.checkSize(key, value); err != nil {
+		return err
 	}
-	defer db.mergeLock.Unlock()
 
-	tmp, err := ioutil.TempDir("", "bitcask_dir_merge")
+	return db.update(func() error {
+		return db.write(key, value, expiry)
+	})
+}
+
+// write appends value under key with the next version and points the
+// keydir to it. The caller must hold db.mu.
+func (db *Bitcask) write(key, value []byte, expiry uint32) error {
+	es := db.split(key, value, time.Now().UnixNano(), expiry, db.nextVersion())
+	pos, err := db.log(es...)
 	if err != nil {
 		return err
 	}
-
-	logFiles, err := ioutil.ReadDir(db.directory)
-	if err != nil {
+	kd := locate(db.activeFile.id, pos, es)
+	kd.key = append([]byte(nil), key...)
+	if err := db.hint(db.activeFile, &kd); err != nil {
 		return err
 	}
+	db.setKey(kd)
+	return nil
+}
 
-	old := []string{}
-	db.mu.Lock()
-	cur := db.activeFile.name
-	aid := db.activeFile.id
-	fkey := make([]int64, 0)
-	for k := range db.dataFiles {
-		if k == aid {
-			continue
-		}
-		fkey = append(fkey, k)
+// locate returns the keydir entry of a value logged as es at pos of a file
+// in the current format.
+func locate(fileID, pos int64, es []*entry) keyDirEntry {
+	end := pos
+	for _, e := range es {
+		end += currentFormat.recordLen(e.flags, e.ksz, e.vsz)
 	}
-	for _, fi := range logFiles {
-		if fi.Name() == cur {
-			continue
-		}
-		old = append(old, fi.Name())
+	kd := keyDirEntry{
+		fileID:    fileID,
+		valueSz:   es[0].vsz,
+		valuePos:  pos + int64(currentFormat.headerLen(es[0].flags)+int(es[0].ksz)),
+		timestamp: es[0].timestamp,
+		flags:     es[0].flags & valueFlags,
+		format:    currentFormat,
+		expiry:    es[0].expiry,
+		version:   es[0].version,
+		key:       es[0].key,
+	}
+	if len(es) > 1 {
+		kd.flags |= flagChunk
+		kd.valueSz = uint32(end - pos)
+		kd.valuePos = pos
 	}
+	return kd
+}
 
-	dbmerge, err := Open(tmp)
-	for k, v := range db.keyDir {
-		if v.fileID == aid {
-			continue
+// split returns the entries storing value, one per chunk when the value
+// is larger than the configured chunk size. The value is compressed first
+// when the configuration asks for it.
+func (db *Bitcask) split(key, value []byte, timestamp int64, expiry uint32, version uint64) []*entry {
+	flags := flagVersion
+	if expiry != 0 {
+		flags |= flagExpiry
+	}
+	if db.shouldCompress(len(value)) {
+		if c := compress(value); c != nil {
+			value = c
+			flags |= flagCompressed
 		}
-		_, dv, _ := db.Get(k)
-		dbmerge.Put(k, dv)
-		db.dataFiles[v.fileID] = dbmerge.dataFiles[v.fileID]
 	}
-	fi, _ := ioutil.ReadDir(tmp)
-	for _, f := range fi {
-		dstp := db.directory + "/" + f.Name()
-		srcp := "/tmp/bitcask_dir_merge/" + f.Name()
-		dst, err := os.Create(dstp)
-		if err != nil {
-			return err
+	size := int(db.config.chunkSize)
+	if len(value) <= size {
+		return []*entry{{
+			timestamp: timestamp,
+			ksz:       uint32(len(key)),
+			vsz:       uint32(len(value)),
+			flags:     flags,
+			expiry:    expiry,
+			version:   version,
+			key:       key,
+			value:     value,
+		}}
+	}
+	es := make([]*entry, 0, (len(value)+size-1)/size)
+	for off := 0; off < len(value); off += size {
+		end := off + size
+		if end > len(value) {
+			end = len(value)
 		}
-		defer dst.Close()
+		e := &entry{
+			timestamp: timestamp,
+			ksz:       uint32(len(key)),
+			vsz:       uint32(end - off),
+			flags:     flags | flagChunk,
+			expiry:    expiry,
+			version:   version,
+			key:       key,
+			value:     value[off:end],
+		}
+		if end == len(value) {
+			e.flags |= flagLastChunk
+		}
+		es = append(es, e)
+	}
+	return es
+}
 
-		src, _ := os.Open(srcp)
-		_, err = io.Copy(dst, src)
-		src.Close()
-		dst.Close()
-		if err == nil {
-			os.Remove(srcp)
+// Get returns a key value from the database
+func (db *Bitcask) Get(key string) (string, string, error) {
+	val, err := db.GetBytes([]byte(key))
+	return key, string(val), err
+}
+
+// GetBytes returns the value of key or nil if the key does not exist.
+func (db *Bitcask) GetBytes(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	kv, ok := db.lookup(string(key))
+	if !ok {
+		return nil, nil
+	}
+	return db.readCached(&kv)
+}
+
+// readCached returns the value kd points to from the value cache, reading
+// and caching it on a miss. The caller must hold db.mu.
+func (db *Bitcask) readCached(kd *keyDirEntry) ([]byte, error) {
+	if val, ok := db.cache.get(string(kd.key)); ok {
+		return val, nil
+	}
+	val, err := db.read(kd)
+	if err == nil {
+		db.cache.add(string(kd.key), val)
+	}
+	return val, err
+}
+
+// read returns the value kd points to. The value never aliases a mapping
+// of the data file: the caller keeps it past db.mu, and a merge or Close
+// may unmap the file at any time after. The caller must hold db.mu.
+func (db *Bitcask) read(kd *keyDirEntry) ([]byte, error) {
+	df := db.dataFiles[kd.fileID]
+	if kd.flags&(flagChunk|flagEncrypted) == 0 {
+		val := make([]byte, kd.valueSz)
+		if err := df.readAt(val, kd.valuePos); err != nil {
+			return nil, err
 		}
+		if kd.flags&flagCompressed != 0 {
+			return decompress(val)
+		}
+		return val, nil
 	}
-	for k, v := range dbmerge.keyDir {
-		db.keyDir[k] = v
+	// join copies the value, so the record is decoded in place.
+	buf, ok := df.mapped(kd.recordPos(), kd.recordSize())
+	if !ok {
+		buf = make([]byte, kd.recordSize())
+		if err := df.readAt(buf, kd.recordPos()); err != nil {
+			return nil, err
+		}
 	}
-	for _, k := range fkey {
-		delete(db.dataFiles, k)
+	val, err := join(buf, df.format, db.aead)
+	if err != nil {
+		return nil, err
 	}
-	db.mu.Unlock()
-	for _, r := range old {
-		os.Remove(r)
+	if kd.flags&flagCompressed != 0 {
+		return decompress(val)
 	}
-	dbmerge.Close()
-	return nil
+	return val, nil
+}
+
+// join reassembles a value from the chain of chunk entries in buf.
+func join(buf []byte, f format, aead cipher.AEAD) ([]byte, error) {
+	es, err := decodeAll(buf, f, aead)
+	if err != nil {
+		return nil, err
+	}
+	var val []byte
+	for _, e := range es {
+		if len(es) > 1 && e.flags&flagChunk == 0 {
+			return nil, errors.New("Chunk error reading entry")
+		}
+		val = append(val, e.value...)
+	}
+	return val, nil
 }
 
-// Sync writes changes to disk
-func (db *Bitcask) Sync() {
-	db.activeFile.w.Sync()
+// decodeAll decodes the consecutive entries in format f in buf.
+func decodeAll(buf []byte, f format, aead cipher.AEAD) ([]*entry, error) {
+	r := bytes.NewBuffer(buf)
+	var es []*entry
+	for r.Len() != 0 {
+		e := &entry{}
+		if err := decode(r, e, f, aead); err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, nil
 }
 
-// Get returns a key value from the database
-func (db *Bitcask) Get(key string) (string, string, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+func (db *Bitcask) checkSize(key, value []byte) error {
+	if err := db.checkKeySize(key); err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		return ErrEmptyValue
+	}
+	if uint32(len(value)) > db.config.maxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
 
-	kv, ok := db.keyDir[key]
-	if ok {
-		val := make([]byte, kv.valueSz)
-		df := db.dataFiles[kv.fileID]
-		df.r.ReadAt(val, kv.valuePos)
-		return key, string(val), nil
+func (db *Bitcask) checkKeySize(key []byte) error {
+	if uint32(len(key)) > db.config.maxKeySize {
+		return ErrKeyTooLarge
 	}
-	return key, "", nil
+	return nil
 }
 
 // Delete key
 func (db *Bitcask) Delete(key string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if _, ok := db.keyDir[key]; !ok {
-		return nil
+	return db.DeleteBytes([]byte(key))
+}
+
+// DeleteBytes removes key from the database.
+func (db *Bitcask) DeleteBytes(key []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
+	return db.update(func() error {
+		if _, ok := db.lookup(string(key)); !ok {
+			return nil
+		}
+		return db.delete(key)
+	})
+}
+
+// delete logs a tombstone for key and drops it from the keydir. The
+// caller must hold db.mu.
+func (db *Bitcask) delete(key []byte) error {
 	tombstone := entry{
-		timestamp: uint32(time.Now().Unix()),
+		timestamp: time.Now().UnixNano(),
 		ksz:       uint32(len(key)),
 		vsz:       0,
-		key:       []byte(key),
+		flags:     flagVersion,
+		version:   db.nextVersion(),
+		key:       key,
 		value:     []byte{},
 	}
-	db.log(&tombstone)
-	delete(db.keyDir, key)
+	pos, err := db.log(&tombstone)
+	if err != nil {
+		return err
+	}
+	kd := locate(db.activeFile.id, pos, []*entry{&tombstone})
+	if err := db.hint(db.activeFile, &kd); err != nil {
+		return err
+	}
+	db.activeFile.stat.deadbytes += int(db.activeFile.offset - pos)
+	db.removeKey(string(key))
 	return nil
 }
 
@@ -477,79 +1217,218 @@ func (db *Bitcask) Delete(key string) error {
 func (db *Bitcask) Size() int {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	return len(db.keyDir)
+	return db.size()
+}
+
+// size returns the number of keys that have not expired. The caller must
+// hold db.mu.
+func (db *Bitcask) size() int {
+	if db.expiring == 0 {
+		return db.keyDir.len()
+	}
+	now := unixNow()
+	n := 0
+	db.keyDir.each(func(kd keyDirEntry) bool {
+		if !kd.expired(now) {
+			n++
+		}
+		return true
+	})
+	return n
 }
 
 // IsEmpty returns true if db is empty.
 func (db *Bitcask) IsEmpty() bool {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	return len(db.keyDir) == 0
+	return db.size() == 0
 }
 
-// Close the database
+// Close the database. It stops a merge in progress and waits for the
+// reads in progress. Calling it again does nothing.
 func (db *Bitcask) Close() {
-	db.activeFile.w.Close()
-	db.activeFile.r.Close()
-	db.activeFile.hw.Close()
-	db.activeFile.hr.Close()
+	db.closeOnce.Do(db.close)
+}
+
+func (db *Bitcask) close() {
+	close(db.done)
+	db.wg.Wait()
+	// A merge reads its sources without db.mu. Closing db.done stops it.
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	if !db.readOnly && db.config.checkpointInterval > 0 {
+		if err := db.checkpoint(); err != nil {
+			log.Printf("bitcask: writing keydir checkpoint: %s", err)
+		}
+	}
+	if !db.readOnly && db.config.sync != SyncNever {
+		db.Sync()
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.readOnly {
+		db.activeFile.w.Close()
+		db.activeFile.hw.Close()
+		db.activeFile.hr.Close()
+	}
 	for _, v := range db.dataFiles {
-		v.r.Close()
+		v.close()
 	}
 	if db.fileLock.Locked() {
 		db.fileLock.Unlock()
 	}
 }
 
-func newDataFile(path string) (*dataFile, error) {
-	t := time.Now().UTC()
-	id := t.Unix()
+func dataFilePath(path string, id int64) string {
+	return filepath.Join(path, fmt.Sprintf("%d.bitcask.data", id))
+}
+
+// newDataFile creates a data file with the next file id. The manifest
+// lists the file before it is created, so that an id is never handed out
+// twice even if the process crashes in between.
+func (db *Bitcask) newDataFile() (*dataFile, error) {
+	id := db.allocFileID()
+	if err := db.writeManifest(id); err != nil {
+		return nil, err
+	}
+	df, err := createDataFile(db.directory, id, db.config.filePerm)
+	if err != nil {
+		return nil, err
+	}
+	db.dataFiles[id] = df
+	db.order = append(db.order, id)
+	return df, nil
+}
+
+// allocFileID returns the next file id. A merge allocates the ids of its
+// outputs without holding db.mu.
+func (db *Bitcask) allocFileID() int64 {
+	return atomic.AddInt64(&db.nextFileID, 1) - 1
+}
 
-	data := fmt.Sprintf("%s/%d.bitcask.data", path, id)
-	w, err := os.OpenFile(data, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+// createDataFile creates a data file and its hint file in the current
+// format.
+func createDataFile(path string, id int64, perm os.FileMode) (*dataFile, error) {
+	data := dataFilePath(path, id)
+	w, err := os.OpenFile(data, os.O_CREATE|os.O_EXCL|os.O_APPEND|os.O_WRONLY, perm)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := w.Write(fileHeader(id, 0)); err != nil {
+		w.Close()
+		return nil, err
+	}
 	r, _ := os.Open(data)
 
-	hint := fmt.Sprintf("%s/%d.bitcask.data.hint", path, id)
-	hw, err := os.OpenFile(hint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+	hint := data + ".hint"
+	hw, err := os.OpenFile(hint, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, perm)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := hw.Write(fileHeader(id, fileHint)); err != nil {
+		hw.Close()
+		return nil, err
+	}
 	hr, _ := os.Open(hint)
 
 	return &dataFile{
 		name:   data,
 		id:     id,
-		offset: 0,
+		format: currentFormat,
+		hint:   true,
+		offset: fileHeaderSize,
 		w:      w,
 		r:      r,
 		hw:     hw,
 		hr:     hr,
+		stat: status{
+			filename:   data,
+			totalbytes: fileHeaderSize,
+		},
 	}, nil
 }
 
-func (db *Bitcask) log(e *entry) {
+// log appends the entries to the active data file with a single write,
+// rotating it when it grows past the configured size, and returns the
+// offset of the first entry. The caller must hold db.mu.
+func (db *Bitcask) log(es ...*entry) (int64, error) {
 	buffer := db.bufferPool.Get().(*bytes.Buffer)
-	encode(buffer, e)
-	db.mu.Lock()
-	if s, _ := db.activeFile.w.Stat(); s.Size() >= threshold {
-		db.activeFile.w.Close()
-		db.activeFile.hw.Close()
-		db.activeFile, _ = newDataFile(db.directory)
+	defer func() {
+		buffer.Reset()
+		db.bufferPool.Put(buffer)
+	}()
+	for _, e := range es {
+		if _, err := encode(buffer, e, currentFormat, db.aead); err != nil {
+			return 0, err
+		}
 	}
-	db.mu.Unlock()
-	l, _ := db.activeFile.w.Write(buffer.Bytes())
+	if db.activeFile.offset >= db.config.maxFileSize {
+		if err := db.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	pos := db.activeFile.offset
+	l, err := db.activeFile.w.Write(buffer.Bytes())
 	db.activeFile.offset = db.activeFile.offset + int64(l)
-	buffer.Reset()
-	db.bufferPool.Put(buffer)
+	db.activeFile.stat.written(l, es[len(es)-1].timestamp)
+	db.group.logged()
+	return pos, err
+}
+
+// rotate makes the active file immutable and starts a new one. The caller
+// must hold db.mu.
+func (db *Bitcask) rotate() error {
+	df, err := db.newDataFile()
+	if err != nil {
+		return err
+	}
+	if db.config.sync != SyncNever {
+		if err := db.activeFile.w.Sync(); err != nil {
+			return err
+		}
+		if err := db.activeFile.hw.Sync(); err != nil {
+			return err
+		}
+	}
+	db.activeFile.w.Close()
+	db.activeFile.hw.Close()
+	db.mapDataFile(db.activeFile)
+	if db.mergeNeeded(db.activeFile) {
+		db.scheduleMerge()
+	}
+	db.activeFile = df
+	return nil
 }
 
-func (db *Bitcask) hint(e *keyDirEntry) {
+// hint appends the entries to the hint file of df with a single write.
+// load trusts a hint file, so when the write fails the hint file is
+// removed and the data file is read instead. The error is returned only
+// if the hint file cannot be removed.
+func (db *Bitcask) hint(df *dataFile, es ...*keyDirEntry) error {
+	if !df.hint {
+		return nil
+	}
 	buffer := db.bufferPool.Get().(*bytes.Buffer)
-	encodeKeyEntry(buffer, e)
-	db.activeFile.hw.Write(buffer.Bytes())
-	buffer.Reset()
-	db.bufferPool.Put(buffer)
+	defer func() {
+		buffer.Reset()
+		db.bufferPool.Put(buffer)
+	}()
+	var err error
+	for _, e := range es {
+		if _, err = encodeKeyEntry(buffer, e, db.aead); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = df.hw.Write(buffer.Bytes())
+	}
+	if err == nil {
+		return nil
+	}
+	log.Printf("bitcask: writing hint file of %s: %s", df.name, err)
+	if rerr := os.Remove(df.name + ".hint"); rerr != nil && !os.IsNotExist(rerr) {
+		return err
+	}
+	df.hint = false
+	return nil
 }
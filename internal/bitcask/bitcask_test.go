@@ -2,12 +2,18 @@ package bitcask
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var testDir string
@@ -27,23 +33,23 @@ func teardown() {
 func TestEntryDataFormat(t *testing.T) {
 	vs := uint32(len("1γγ2"))
 	e := entry{
-		1234,
-		1234,
-		2,
-		vs,
-		[]byte("12"),
-		[]byte("1γγ2"),
+		crc:       1234,
+		timestamp: 1234,
+		ksz:       2,
+		vsz:       vs,
+		key:       []byte("12"),
+		value:     []byte("1γγ2"),
 	}
 	var buff bytes.Buffer
-	s, err := encode(&buff, &e)
+	s, err := encode(&buff, &e, currentFormat, nil)
 	if err != nil {
 		t.Fatalf("Non expected error: %s", err.Error())
 	}
-	if s != int(headerSize+e.ksz+e.vsz) {
-		t.Errorf("expected %d but got %d, data: %s", headerSize+e.ksz+e.vsz, s, hex.EncodeToString(buff.Bytes()))
+	if want := currentFormat.headerSize() + int(e.ksz+e.vsz); s != want {
+		t.Errorf("expected %d but got %d, data: %s", want, s, hex.EncodeToString(buff.Bytes()))
 	}
 	e2 := &entry{}
-	err = decode(&buff, e2)
+	err = decode(&buff, e2, currentFormat, nil)
 	if err != nil {
 		t.Fatalf("Non expected error: %s", err.Error())
 	}
@@ -242,6 +248,116 @@ func TestLoadFromExisting(t *testing.T) {
 	t.Logf("data: %v", db.keyDir)
 }
 
+func TestLoadDeletedFromExisting(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(dir string)
+	}{
+		{name: "from hint files", prepare: func(string) {}},
+		{name: "from data files", prepare: func(dir string) {
+			hints, _ := filepath.Glob(filepath.Join(dir, "*.hint"))
+			for _, h := range hints {
+				os.Remove(h)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Error("Non expected error")
+			}
+			db.Put("12", "1234")
+			db.Put("ab", "abcnull")
+			db.Put("1234", "12345")
+			db.Delete("ab")
+			db.Close()
+
+			// Delete and put again across data files.
+			db, err = Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Error("Non expected error")
+			}
+			db.Delete("12")
+			db.Delete("1234")
+			db.Close()
+			db, err = Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Error("Non expected error")
+			}
+			db.Put("1234", "abc")
+			db.Close()
+
+			tc.prepare(dir)
+			db, err = Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			for _, k := range []string{"ab", "12"} {
+				if k, v, e := db.Get(k); e != nil || v != "" || db.HasKey(k) {
+					t.Errorf("error %v key %v value [%v] data %v", e, k, v, db.keyDir)
+				}
+			}
+			k, v, e := db.Get("1234")
+			if e != nil || (k != "1234" || v != "abc") {
+				t.Errorf("error %v key %v value [%v] data %v", e, k, v, db.keyDir)
+			}
+			if s := db.Size(); s != 1 {
+				t.Errorf("expected %d but got %d", 1, s)
+			}
+		})
+	}
+}
+
+func TestHintWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithAutoMerge(false), WithCheckpointInterval(0)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "1")
+	db.Put("b", "2")
+	// The hint file misses the writes that follow, so it must not be
+	// trusted on the next open.
+	db.activeFile.hw.Close()
+	if err := db.Put("a", "3"); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	b := NewBatch()
+	b.Put("c", "4")
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	name := db.activeFile.name
+	db.Close()
+	if _, err := os.Stat(name + ".hint"); !os.IsNotExist(err) {
+		t.Errorf("expected the hint file to be removed but got %v", err)
+	}
+
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	checkMergeStore(t, db, map[string]string{"a": "3", "c": "4"})
+}
+
 func BenchmarkPutSameKey(b *testing.B) {
 	dir, err := ioutil.TempDir("", "bitcask_dir_")
 	if err != nil {
@@ -255,3 +371,371 @@ func BenchmarkPutSameKey(b *testing.B) {
 		db.Put("single", "aaaaaaaaaaaaaaaaaddddddddddddddddddddccccccccccccccc")
 	}
 }
+
+// BenchmarkGet compares reads of an immutable data file with ReadAt and
+// from its mapping. Both copy the value, so Mmap saves the system call.
+func BenchmarkGet(b *testing.B) {
+	for _, mmap := range []bool{false, true} {
+		name := "ReadAt"
+		if mmap {
+			name = "Mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			db, err := Open(dir, WithAutoMerge(false), WithMmap(mmap))
+			if err != nil {
+				b.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			keys := make([]string, 1000)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key%d", i)
+				db.Put(keys[i], "aaaaaaaaaaaaaaaaaddddddddddddddddddddccccccccccccccc")
+			}
+			db.mu.Lock()
+			db.rotate()
+			db.mu.Unlock()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				db.Get(keys[n%len(keys)])
+			}
+		})
+	}
+}
+
+func TestOpenOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := map[string]Option{
+		"zero file size":     WithMaxFileSize(0),
+		"zero key size":      WithMaxKeySize(0),
+		"zero value size":    WithMaxValueSize(0),
+		"unwritable files":   WithFilePerm(0444),
+		"fragmentation >100": WithFragmentation(101),
+		"negative dead size": WithDeadBytesThreshold(-1),
+	}
+	for name, opt := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Open(dir, opt); err == nil {
+				t.Fatalf("expected error for invalid option")
+			}
+		})
+	}
+
+	db, err := Open(dir, WithMaxKeySize(4), WithMaxValueSize(4096), WithMaxFileSize(64))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+
+	if err := db.Put("large", "v"); err != ErrKeyTooLarge {
+		t.Errorf("expected %v but got %v", ErrKeyTooLarge, err)
+	}
+	if err := db.Put("k", strings.Repeat("v", 4097)); err != ErrValueTooLarge {
+		t.Errorf("expected %v but got %v", ErrValueTooLarge, err)
+	}
+	value := strings.Repeat("v", 4096)
+	if err := db.Put("k", value); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("k2", "v2")
+	if _, v, _ := db.Get("k"); v != value {
+		t.Errorf("expected value of %d bytes but got %d", len(value), len(v))
+	}
+	if _, v, _ := db.Get("k2"); v != "v2" {
+		t.Errorf("expected %v but got %v", "v2", v)
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	db.Put("a", "1")
+
+	// An empty value would read back as a deletion after a reopen.
+	batch := NewBatch()
+	batch.Delete("a")
+	batch.PutBytes([]byte("b"), []byte{})
+	writes := map[string]func() error{
+		"put":     func() error { return db.Put("b", "") },
+		"bytes":   func() error { return db.PutBytes([]byte("b"), []byte{}) },
+		"ttl":     func() error { return db.PutWithTTL("b", "", time.Minute) },
+		"batch":   func() error { return db.Write(batch) },
+		"absent":  func() error { return db.PutIfAbsent("b", "") },
+		"cas":     func() error { return db.CompareAndSwap("a", "1", "") },
+		"version": func() error { return db.PutIfVersion([]byte("b"), []byte{}, 0) },
+	}
+	for name, write := range writes {
+		if err := write(); err != ErrEmptyValue {
+			t.Errorf("%s: expected %v but got %v", name, ErrEmptyValue, err)
+		}
+	}
+	if _, v, _ := db.Get("a"); v != "1" || db.HasKey("b") {
+		t.Errorf("expected only a=1 but got keys %v", db.Keys())
+	}
+
+	batch = NewBatch()
+	batch.Delete("a")
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if db.HasKey("a") {
+		t.Errorf("expected %v to be deleted", "a")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "1")
+	db.Close()
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	if _, v, _ := db.Get("a"); v != "1" {
+		t.Errorf("expected %v but got %v", "1", v)
+	}
+}
+
+func TestCloseWhileReadingAndMerging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithAutoMerge(false), WithMaxFileSize(64), WithMmap(true)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	want := fillMergeStore(db)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Reads after Close fail but must not touch unmapped memory.
+				for k := range want {
+					db.Get(k)
+				}
+			}
+		}()
+	}
+	merged := make(chan error, 1)
+	started := make(chan struct{})
+	go func() {
+		// The merge copies slowly enough to be in progress on Close.
+		opts := MergeOptions{BytesPerSec: 256, Progress: func(MergeProgress) {
+			select {
+			case <-started:
+			default:
+				close(started)
+			}
+		}}
+		_, err := db.MergeContext(context.Background(), opts)
+		merged <- err
+	}()
+	<-started
+	db.Close()
+	if err := <-merged; err != context.Canceled {
+		t.Errorf("expected %v but got %v", context.Canceled, err)
+	}
+	close(stop)
+	wg.Wait()
+	if err := db.Merge(); err == nil {
+		t.Errorf("expected error merging a closed store")
+	}
+
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	checkMergeStore(t, db, want)
+}
+
+func TestBytesAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+
+	key := []byte{0x00, 0xff, 'k'}
+	value := []byte{0x00, 0x01, 0xfe, 0xff, 0x00}
+	if err := db.PutBytes(key, value); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	got, err := db.GetBytes(key)
+	if err != nil || !bytes.Equal(value, got) {
+		t.Errorf("expected %v but got %v, err %v", value, got, err)
+	}
+	if !db.HasKeyBytes(key) {
+		t.Errorf("expected key %v to exist", key)
+	}
+	if ks := db.KeysBytes(); len(ks) != 1 || !bytes.Equal(ks[0], key) {
+		t.Errorf("expected [%v] but got %v", key, ks)
+	}
+	if got, _ := db.GetBytes([]byte("missing")); got != nil {
+		t.Errorf("expected nil but got %v", got)
+	}
+
+	db.Close()
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	got, err = db.GetBytes(key)
+	if err != nil || !bytes.Equal(value, got) {
+		t.Errorf("expected %v but got %v, err %v", value, got, err)
+	}
+	db.DeleteBytes(key)
+	if db.HasKeyBytes(key) {
+		t.Errorf("expected key %v to be deleted", key)
+	}
+}
+
+func TestChunkedValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithChunkSize(1024))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	large := make([]byte, 3*1_000_000+17)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	if err := db.PutBytes([]byte("large"), large); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("small", "value")
+	got, err := db.GetBytes([]byte("large"))
+	if err != nil || !bytes.Equal(large, got) {
+		t.Fatalf("expected value of %d bytes but got %d, err %v", len(large), len(got), err)
+	}
+	db.Close()
+
+	tests := []struct {
+		name    string
+		prepare func()
+	}{
+		{name: "from hint files", prepare: func() {}},
+		{name: "from data files", prepare: func() {
+			hints, _ := filepath.Glob(filepath.Join(dir, "*.hint"))
+			for _, h := range hints {
+				os.Remove(h)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.prepare()
+			db, err := Open(dir)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			got, err := db.GetBytes([]byte("large"))
+			if err != nil || !bytes.Equal(large, got) {
+				t.Errorf("expected value of %d bytes but got %d, err %v", len(large), len(got), err)
+			}
+			if _, v, _ := db.Get("small"); v != "value" {
+				t.Errorf("expected %v but got %v", "value", v)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithChunkSize(16), WithMaxFileSize(256))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	want := map[string]string{}
+	for i := 0; i < 50; i++ {
+		k := fmt.Sprintf("key%d", i%10)
+		v := strings.Repeat(fmt.Sprintf("%d", i), i)
+		db.Put(k, v)
+		want[k] = v
+	}
+	db.Delete("key3")
+	delete(want, "key3")
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	check := func(db *Bitcask) {
+		for k, v := range want {
+			if _, got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("expected %v but got %v, err %v", v, got, err)
+			}
+		}
+		if db.HasKey("key3") {
+			t.Errorf("expected key3 to be deleted")
+		}
+	}
+	check(db)
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	check(db)
+}
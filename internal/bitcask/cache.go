@@ -0,0 +1,137 @@
+package bitcask
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats reports the use of the value cache enabled with
+// WithValueCache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Entries and Bytes describe the values currently cached. Bytes
+	// counts their keys too.
+	Entries int
+	Bytes   int64
+}
+
+// CacheStats returns the counters of the value cache. They are zero when
+// the cache is disabled.
+func (db *Bitcask) CacheStats() CacheStats {
+	return db.cache.stats()
+}
+
+// valueCache keeps the most recently read values up to a total size in
+// bytes, evicting the least recently used ones. Readers share db.mu, so
+// it has a lock of its own. A nil cache caches nothing.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	lru      *list.List
+	items    map[string]*list.Element
+	st       CacheStats
+}
+
+type cacheItem struct {
+	key   string
+	value []byte
+}
+
+func (it *cacheItem) size() int64 {
+	return int64(len(it.key) + len(it.value))
+}
+
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the cached value of key.
+func (c *valueCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.st.Misses++
+		return nil, false
+	}
+	c.st.Hits++
+	c.lru.MoveToFront(el)
+	return append([]byte(nil), el.Value.(*cacheItem).value...), true
+}
+
+// add caches a copy of the value of key, evicting the least recently
+// used values to make room. Values larger than the cache are skipped.
+func (c *valueCache) add(key string, value []byte) {
+	if c == nil {
+		return
+	}
+	it := &cacheItem{key: key, value: append([]byte(nil), value...)}
+	if it.size() > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	c.items[key] = c.lru.PushFront(it)
+	c.st.Entries++
+	c.st.Bytes += it.size()
+	for c.st.Bytes > c.capacity {
+		c.remove(c.lru.Back().Value.(*cacheItem).key)
+		c.st.Evictions++
+	}
+}
+
+// invalidate drops the cached value of key.
+func (c *valueCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.remove(key)
+	c.mu.Unlock()
+}
+
+// purge drops every cached value.
+func (c *valueCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.st.Entries, c.st.Bytes = 0, 0
+	c.mu.Unlock()
+}
+
+func (c *valueCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.st
+}
+
+// remove drops key. The caller must hold c.mu.
+func (c *valueCache) remove(key string) {
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	it := c.lru.Remove(el).(*cacheItem)
+	delete(c.items, key)
+	c.st.Entries--
+	c.st.Bytes -= it.size()
+}
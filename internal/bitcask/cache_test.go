@@ -0,0 +1,100 @@
+package bitcask
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Room for two values of 9 bytes with their keys.
+	db, err := Open(dir, WithAutoMerge(false), WithValueCache(25))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		db.Put(k, k+"00000000")
+	}
+
+	get := func(k, want string) {
+		t.Helper()
+		if _, got, err := db.Get(k); err != nil || got != want {
+			t.Errorf("%s: expected %v but got %v, err %v", k, want, got, err)
+		}
+	}
+	tests := []struct {
+		name string
+		run  func()
+		want CacheStats
+	}{
+		{"miss", func() { get("a", "a00000000") }, CacheStats{Misses: 1, Entries: 1, Bytes: 10}},
+		{"hit", func() { get("a", "a00000000") }, CacheStats{Hits: 1, Misses: 1, Entries: 1, Bytes: 10}},
+		{"evict least recently used", func() {
+			get("b", "b00000000")
+			get("a", "a00000000")
+			get("c", "c00000000")
+			get("a", "a00000000")
+		}, CacheStats{Hits: 3, Misses: 3, Evictions: 1, Entries: 2, Bytes: 20}},
+		{"evicted", func() { get("b", "b00000000") }, CacheStats{Hits: 3, Misses: 4, Evictions: 2, Entries: 2, Bytes: 20}},
+		{"put", func() {
+			db.Put("b", "b11111111")
+			get("b", "b11111111")
+		}, CacheStats{Hits: 3, Misses: 5, Evictions: 2, Entries: 2, Bytes: 20}},
+		{"delete", func() {
+			db.Delete("b")
+			get("b", "")
+		}, CacheStats{Hits: 3, Misses: 5, Evictions: 2, Entries: 1, Bytes: 10}},
+		{"merge", func() {
+			db.mu.Lock()
+			db.rotate()
+			db.mu.Unlock()
+			if err := db.Merge(); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			get("a", "a00000000")
+		}, CacheStats{Hits: 3, Misses: 6, Evictions: 2, Entries: 1, Bytes: 10}},
+		{"get versioned", func() {
+			db.GetVersioned([]byte("a"))
+			db.GetVersioned([]byte("c"))
+		}, CacheStats{Hits: 4, Misses: 7, Evictions: 2, Entries: 2, Bytes: 20}},
+		{"compare and swap", func() {
+			if err := db.CompareAndSwap("c", "c00000000", "c11111111"); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+		}, CacheStats{Hits: 5, Misses: 7, Evictions: 2, Entries: 1, Bytes: 10}},
+	}
+	for _, tt := range tests {
+		tt.run()
+		if got := db.CacheStats(); got != tt.want {
+			t.Errorf("%s: expected %+v but got %+v", tt.name, tt.want, got)
+		}
+	}
+
+	// Values handed out by the cache are copies.
+	v, _ := db.GetBytes([]byte("a"))
+	v[0] = 'x'
+	get("a", "a00000000")
+	get("c", "c11111111")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				get("a", "a00000000")
+				get("c", "c11111111")
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,147 @@
+package bitcask
+
+import "bytes"
+
+// nextVersion returns the version of the next write. Versions come from a
+// single sequence, so the version of every key increases with each write
+// and is never reused after a delete. The caller must hold db.mu.
+func (db *Bitcask) nextVersion() uint64 {
+	db.version++
+	return db.version
+}
+
+// condition decides whether a conditional write may replace the current
+// entry of its key. ok is false when the key does not exist.
+type condition func(kd *keyDirEntry, ok bool) (bool, error)
+
+func absent(kd *keyDirEntry, ok bool) (bool, error) {
+	return !ok, nil
+}
+
+func (db *Bitcask) equals(value []byte) condition {
+	return func(kd *keyDirEntry, ok bool) (bool, error) {
+		if !ok {
+			return false, nil
+		}
+		v, err := db.readCached(kd)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(v, value), nil
+	}
+}
+
+func atVersion(version uint64) condition {
+	return func(kd *keyDirEntry, ok bool) (bool, error) {
+		if !ok {
+			return version == 0, nil
+		}
+		return kd.version == version, nil
+	}
+}
+
+// putIf writes value under key if cond accepts its current entry.
+func (db *Bitcask) putIf(key, value []byte, cond condition) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkSize(key, value); err != nil {
+		return err
+	}
+
+	return db.update(func() error {
+		kd, ok := db.lookup(string(key))
+		match, err := cond(&kd, ok)
+		if err != nil {
+			return err
+		}
+		if !match {
+			return ErrConditionFailed
+		}
+		return db.write(key, value, 0)
+	})
+}
+
+// deleteIf deletes key if it exists and cond accepts its current entry.
+func (db *Bitcask) deleteIf(key []byte, cond condition) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.update(func() error {
+		kd, ok := db.lookup(string(key))
+		match, err := cond(&kd, ok)
+		if err != nil {
+			return err
+		}
+		if !ok || !match {
+			return ErrConditionFailed
+		}
+		return db.delete(key)
+	})
+}
+
+// PutIfAbsent adds the key value only if the key does not exist.
+// It returns ErrConditionFailed otherwise.
+func (db *Bitcask) PutIfAbsent(key, value string) error {
+	return db.PutIfAbsentBytes([]byte(key), []byte(value))
+}
+
+// PutIfAbsentBytes adds the key value only if the key does not exist.
+// It returns ErrConditionFailed otherwise.
+func (db *Bitcask) PutIfAbsentBytes(key, value []byte) error {
+	return db.putIf(key, value, absent)
+}
+
+// CompareAndSwap replaces the value of key with value only if its current
+// value is old. It returns ErrConditionFailed otherwise.
+func (db *Bitcask) CompareAndSwap(key, old, value string) error {
+	return db.CompareAndSwapBytes([]byte(key), []byte(old), []byte(value))
+}
+
+// CompareAndSwapBytes replaces the value of key with value only if its
+// current value is old. It returns ErrConditionFailed otherwise.
+func (db *Bitcask) CompareAndSwapBytes(key, old, value []byte) error {
+	return db.putIf(key, value, db.equals(old))
+}
+
+// DeleteIfEquals deletes key only if its current value is value.
+// It returns ErrConditionFailed otherwise.
+func (db *Bitcask) DeleteIfEquals(key, value string) error {
+	return db.DeleteIfEqualsBytes([]byte(key), []byte(value))
+}
+
+// DeleteIfEqualsBytes deletes key only if its current value is value.
+// It returns ErrConditionFailed otherwise.
+func (db *Bitcask) DeleteIfEqualsBytes(key, value []byte) error {
+	return db.deleteIf(key, db.equals(value))
+}
+
+// GetVersioned returns the value of key with its version. A missing key
+// has version 0.
+func (db *Bitcask) GetVersioned(key []byte) ([]byte, uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	kd, ok := db.lookup(string(key))
+	if !ok {
+		return nil, 0, nil
+	}
+	v, err := db.readCached(&kd)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, kd.version, nil
+}
+
+// PutIfVersion writes the key value only if the current version of key is
+// version, where version 0 requires the key to be missing. It returns
+// ErrConditionFailed otherwise.
+func (db *Bitcask) PutIfVersion(key, value []byte, version uint64) error {
+	return db.putIf(key, value, atVersion(version))
+}
+
+// DeleteIfVersion deletes key only if its current version is version.
+// It returns ErrConditionFailed otherwise.
+func (db *Bitcask) DeleteIfVersion(key []byte, version uint64) error {
+	return db.deleteIf(key, atVersion(version))
+}
@@ -0,0 +1,165 @@
+package bitcask
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name  string
+		op    func() error
+		err   error
+		value string
+	}{
+		{"put if absent", func() error { return db.PutIfAbsent("k", "1") }, nil, "1"},
+		{"put if absent existing", func() error { return db.PutIfAbsent("k", "2") }, ErrConditionFailed, "1"},
+		{"swap mismatch", func() error { return db.CompareAndSwap("k", "2", "3") }, ErrConditionFailed, "1"},
+		{"swap", func() error { return db.CompareAndSwap("k", "1", "3") }, nil, "3"},
+		{"delete mismatch", func() error { return db.DeleteIfEquals("k", "1") }, ErrConditionFailed, "3"},
+		{"delete", func() error { return db.DeleteIfEquals("k", "3") }, nil, ""},
+		{"delete missing", func() error { return db.DeleteIfEquals("k", "3") }, ErrConditionFailed, ""},
+		{"swap missing", func() error { return db.CompareAndSwap("k", "", "4") }, ErrConditionFailed, ""},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.err, err)
+		}
+		if _, v, _ := db.Get("k"); v != tt.value {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.value, v)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	key := []byte("k")
+	if err := db.PutIfVersion(key, []byte("1"), 0); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	_, v1, _ := db.GetVersioned(key)
+	db.Put("k", "2")
+	_, v2, _ := db.GetVersioned(key)
+	if v1 == 0 || v2 <= v1 {
+		t.Errorf("expected increasing versions but got %d, %d", v1, v2)
+	}
+	if err := db.PutIfVersion(key, []byte("3"), v1); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("expected %v but got %v", ErrConditionFailed, err)
+	}
+	db.Delete("k")
+	db.Close()
+
+	for _, hints := range []bool{true, false} {
+		if !hints {
+			for _, name := range dataFileNames(dir) {
+				os.Remove(name + ".hint")
+			}
+		}
+		db, err = Open(dir)
+		if err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		if err := db.PutIfVersion(key, []byte("3"), 0); err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		_, v3, _ := db.GetVersioned(key)
+		if v3 <= v2 {
+			t.Errorf("expected version after %d but got %d", v2, v3)
+		}
+		if err := db.DeleteIfVersion(key, v3); err != nil {
+			t.Errorf("Non expected error: %s", err.Error())
+		}
+		v2 = v3
+		db.Close()
+	}
+
+	// A merge of the oldest files drops the tombstones and their versions,
+	// which the manifest keeps without a keydir checkpoint.
+	opts := []Option{WithAutoMerge(false), WithCheckpointInterval(0)}
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("j", "1")
+	_, vj, _ := db.GetVersioned([]byte("j"))
+	db.Delete("j")
+	db.mu.Lock()
+	db.rotate()
+	db.mu.Unlock()
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Close()
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	db.Put("j", "2")
+	if _, v, _ := db.GetVersioned([]byte("j")); v <= vj {
+		t.Errorf("expected version after %d but got %d", vj, v)
+	}
+	if err := db.PutIfVersion([]byte("j"), []byte("3"), vj); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("expected %v but got %v", ErrConditionFailed, err)
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	db.Put("counter", "0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; {
+				_, v, _ := db.Get("counter")
+				c, _ := strconv.Atoi(v)
+				if db.CompareAndSwap("counter", v, strconv.Itoa(c+1)) == nil {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, v, _ := db.Get("counter"); v != "400" {
+		t.Errorf("expected %v but got %v", "400", v)
+	}
+}
@@ -0,0 +1,248 @@
+package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointFile holds a snapshot of the keydir together with the data
+// files it covers and their offsets, so that Open only replays what was
+// written after it.
+const checkpointFile = "KEYDIR"
+
+// The checkpoint is laid out as file header | version(8) | count(4) |
+// count * (id(8) | offset(8)) | crc(4), followed by a group of hint
+// records per covered file: format(2) | count(4) | count * record |
+// crc(4).
+const checkpointFileSize = 16
+
+// errStaleCheckpoint is returned when the data files changed in a way the
+// checkpoint cannot be brought up to date with, as after a merge.
+var errStaleCheckpoint = errors.New("stale keydir checkpoint")
+
+// coveredFile is a data file covered by the checkpoint up to offset.
+type coveredFile struct {
+	id     int64
+	offset int64
+	format format
+}
+
+// checkpoint writes the keydir checkpoint. The keydir is copied under the
+// read lock and written out without holding it. The covered data is
+// synced first, so that the checkpoint never points past it.
+func (db *Bitcask) checkpoint() error {
+	db.mu.RLock()
+	snap := db.keyDir.snapshot()
+	files := make([]coveredFile, len(db.order))
+	dfs := make([]*dataFile, len(db.order))
+	for i, id := range db.order {
+		df := db.dataFiles[id]
+		files[i] = coveredFile{id: id, offset: df.offset, format: df.format}
+		dfs[i] = df
+	}
+	version, aead := db.version, db.aead
+	db.mu.RUnlock()
+
+	for _, df := range dfs {
+		// A file merged away in the meantime makes the checkpoint stale.
+		if err := df.r.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	group := make(map[int64]int, len(files))
+	for i, f := range files {
+		group[f.id] = i
+	}
+	groups := make([][]uint32, len(files))
+	for i := range snap.entries {
+		e := &snap.entries[i]
+		if e.slab == freeSlab {
+			continue
+		}
+		g, ok := group[snap.files[e.file]]
+		if !ok {
+			return fmt.Errorf("key in unknown data file %d", snap.files[e.file])
+		}
+		groups[g] = append(groups[g], uint32(i))
+	}
+
+	return replaceFile(filepath.Join(db.directory, checkpointFile), db.config.filePerm, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		var head bytes.Buffer
+		head.Write(fileHeader(0, fileCheckpoint))
+		binary.Write(&head, binary.BigEndian, version)
+		binary.Write(&head, binary.BigEndian, uint32(len(files)))
+		for _, f := range files {
+			binary.Write(&head, binary.BigEndian, f.id)
+			binary.Write(&head, binary.BigEndian, f.offset)
+		}
+		binary.Write(&head, binary.BigEndian, crc32.ChecksumIEEE(head.Bytes()))
+		bw.Write(head.Bytes())
+
+		var rec bytes.Buffer
+		for i, f := range files {
+			crc := crc32.NewIEEE()
+			gw := io.MultiWriter(bw, crc)
+			binary.Write(gw, binary.BigEndian, uint16(f.format))
+			binary.Write(gw, binary.BigEndian, uint32(len(groups[i])))
+			for _, ent := range groups[i] {
+				kd := snap.at(ent)
+				rec.Reset()
+				if _, err := encodeKeyEntry(&rec, &kd, aead); err != nil {
+					return err
+				}
+				gw.Write(rec.Bytes())
+			}
+			binary.Write(bw, binary.BigEndian, crc.Sum32())
+		}
+		return bw.Flush()
+	})
+}
+
+// loadCheckpoint applies the keydir checkpoint when it covers the first
+// files of m and returns the offsets it covers. A missing, stale or
+// damaged checkpoint is ignored and the data files are replayed in full.
+func (db *Bitcask) loadCheckpoint(m *manifest, now uint32) []int64 {
+	covered, err := db.readCheckpoint(m, now)
+	if err == nil {
+		return covered
+	}
+	if !os.IsNotExist(err) && err != errStaleCheckpoint {
+		log.Printf("bitcask: ignoring keydir checkpoint: %s", err)
+	}
+	db.keyDir = newKeyDir()
+	db.index = newSkiplist(db.keyDir)
+	db.version, db.expiring = 0, 0
+	return nil
+}
+
+func (db *Bitcask) readCheckpoint(m *manifest, now uint32) ([]int64, error) {
+	f, err := os.Open(filepath.Join(db.directory, checkpointFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if v, err := readFileHeader(f, 0, fileCheckpoint); err != nil {
+		return nil, err
+	} else if v == formatV0 {
+		return nil, errors.New("not a keydir checkpoint")
+	}
+
+	r := bufio.NewReader(f)
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+	head := make([]byte, fileHeaderSize+12)
+	if _, err := io.ReadFull(tr, head); err != nil {
+		return nil, err
+	}
+	version := binary.BigEndian.Uint64(head[fileHeaderSize:])
+	n := int(binary.BigEndian.Uint32(head[fileHeaderSize+8:]))
+	if n > len(m.files) {
+		return nil, errStaleCheckpoint
+	}
+	files := make([]byte, n*checkpointFileSize)
+	if _, err := io.ReadFull(tr, files); err != nil {
+		return nil, err
+	}
+	if err := readChecksum(r, crc.Sum32()); err != nil {
+		return nil, err
+	}
+	covered := make([]int64, n)
+	for i := range covered {
+		id := int64(binary.BigEndian.Uint64(files[i*checkpointFileSize:]))
+		covered[i] = int64(binary.BigEndian.Uint64(files[i*checkpointFileSize+8:]))
+		if id != m.files[i].id {
+			return nil, errStaleCheckpoint
+		}
+		// The data written since may have been lost in a crash.
+		fi, err := os.Stat(dataFilePath(db.directory, id))
+		if err != nil || fi.Size() < covered[i] {
+			return nil, errStaleCheckpoint
+		}
+	}
+
+	for i := range covered {
+		id := int64(binary.BigEndian.Uint64(files[i*checkpointFileSize:]))
+		crc.Reset()
+		var gh [6]byte
+		if _, err := io.ReadFull(tr, gh[:]); err != nil {
+			return nil, err
+		}
+		ff := format(binary.BigEndian.Uint16(gh[0:2]))
+		if ff > currentFormat {
+			return nil, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, ff)
+		}
+		count := int(binary.BigEndian.Uint32(gh[2:6]))
+		entries := make([]keyDirEntry, 0, minInt(count, 1<<16))
+		for j := 0; j < count; j++ {
+			rec := make([]byte, ff.hintHeaderSize())
+			if _, err := io.ReadFull(tr, rec); err != nil {
+				return nil, err
+			}
+			ks := binary.BigEndian.Uint32(rec[ff.timestampSize():])
+			size := ff.hintRecordLen(uint8(ks>>flagShift), ks&kszMask)
+			rec = append(rec, make([]byte, size-len(rec))...)
+			if _, err := io.ReadFull(tr, rec[ff.hintHeaderSize():]); err != nil {
+				return nil, err
+			}
+			ke := keyDirEntry{fileID: id, format: ff}
+			if _, err := decodeKeyEntry(bytes.NewBuffer(rec), &ke, db.aead); err != nil {
+				return nil, err
+			}
+			entries = append(entries, ke)
+		}
+		if err := readChecksum(r, crc.Sum32()); err != nil {
+			return nil, err
+		}
+		db.replay(entries, now)
+	}
+	if version > db.version {
+		db.version = version
+	}
+	return covered, nil
+}
+
+// readChecksum reads a crc from r and compares it with sum.
+func readChecksum(r io.Reader, sum uint32) error {
+	var crc uint32
+	if err := binary.Read(r, binary.BigEndian, &crc); err != nil {
+		return err
+	}
+	if crc != sum {
+		return errors.New("Checksum error reading keydir checkpoint")
+	}
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// checkpointer writes the keydir checkpoint every interval.
+func (db *Bitcask) checkpointer(interval time.Duration) {
+	defer db.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-t.C:
+			if err := db.checkpoint(); err != nil {
+				log.Printf("bitcask: writing keydir checkpoint: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package bitcask
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	tests := map[string][]Option{
+		"plain":     nil,
+		"encrypted": {WithEncryptionKey(bytes.Repeat([]byte{7}, 32))},
+	}
+	for name, extra := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opts := append([]Option{WithAutoMerge(false), WithCheckpointInterval(0)}, extra...)
+			db, err := Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			rotate := func() {
+				db.mu.Lock()
+				db.rotate()
+				db.mu.Unlock()
+			}
+			db.Put("a", "1")
+			db.Put("b", "2")
+			rotate()
+			db.Put("c", "3")
+			if err := db.checkpoint(); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			// Written after the checkpoint, in the file it covers part of
+			// and in a newer one.
+			db.Put("a", "4")
+			db.Delete("b")
+			rotate()
+			db.Put("d", "5")
+			db.Close()
+			want := map[string]string{"a": "4", "c": "3", "d": "5"}
+
+			reopen := func(step string) {
+				t.Helper()
+				db, err = Open(dir, opts...)
+				if err != nil {
+					t.Fatalf("%s: Non expected error: %s", step, err.Error())
+				}
+				checkMergeStore(t, db, want)
+			}
+
+			// The hint file of the covered file is not read.
+			hint := dataFileNames(dir)[0] + ".hint"
+			backup, _ := ioutil.ReadFile(hint)
+			ioutil.WriteFile(hint, []byte("garbage"), 0644)
+			reopen("hint file covered")
+			db.Close()
+			ioutil.WriteFile(hint, backup, 0644)
+
+			// A damaged checkpoint is ignored.
+			name := filepath.Join(dir, checkpointFile)
+			data, _ := ioutil.ReadFile(name)
+			data[len(data)-6] ^= 0xff
+			ioutil.WriteFile(name, data, 0644)
+			reopen("damaged checkpoint")
+
+			// After a merge, the checkpoint no longer matches the files.
+			if err := db.checkpoint(); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			rotate()
+			if err := db.Merge(); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			db.Close()
+			reopen("merged")
+			db.Close()
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package bitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"sync"
+)
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// compress returns value deflated, or nil when the compressed form would
+// not be smaller.
+func compress(value []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(value) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func decompress(value []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(value))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// shouldCompress returns true if a value of the given size is compressed
+// when written.
+func (db *Bitcask) shouldCompress(size int) bool {
+	return db.config.compression && size >= int(db.config.compressionThreshold)
+}
@@ -0,0 +1,102 @@
+package bitcask
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	// With chunks of 16 bytes every compressed value is chunked; with the
+	// default size it is a single record.
+	chunks := map[string]uint32{
+		"chunked":   16,
+		"unchunked": chunkSize,
+	}
+	for name, chunk := range chunks {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			verbose := strings.Repeat(`{"name":"value","list":[1,2,3]}`, 100)
+			db, err := Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			db.Put("old", verbose)
+			db.Close()
+
+			opts := []Option{WithAutoMerge(false), WithCompression(true), WithCompressionThreshold(64), WithChunkSize(chunk)}
+			db, err = Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			db.Put("new", verbose)
+			db.Put("small", "tiny")
+			if kd, _ := db.keyDir.get("new"); (kd.flags&flagChunk != 0) != (name == "chunked") {
+				t.Errorf("expected chunked %t but got flags %b", name == "chunked", kd.flags)
+			}
+
+			expected := map[string]struct {
+				value      string
+				compressed bool
+			}{
+				"old":   {verbose, false},
+				"new":   {verbose, true},
+				"small": {"tiny", false},
+			}
+			check := func(db *Bitcask) {
+				for k, v := range expected {
+					if _, got, err := db.Get(k); err != nil || got != v.value {
+						t.Errorf("%s: expected %d bytes but got %d (%v)", k, len(v.value), len(got), err)
+					}
+					if kd, _ := db.keyDir.get(k); (kd.flags&flagCompressed != 0) != v.compressed {
+						t.Errorf("%s: expected compressed %t but got flags %b", k, v.compressed, kd.flags)
+					}
+				}
+				db.Fold(func(key string, value []byte) error {
+					if string(value) != expected[key].value {
+						t.Errorf("%s: expected %d bytes but got %d", key, len(expected[key].value), len(value))
+					}
+					return nil
+				})
+			}
+			check(db)
+			if kd, _ := db.keyDir.get("new"); kd.recordSize() >= int64(len(verbose)) {
+				t.Errorf("expected compressed record but got %d bytes", kd.recordSize())
+			}
+
+			if err := db.Merge(); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			expected["old"] = struct {
+				value      string
+				compressed bool
+			}{verbose, true}
+			check(db)
+			db.Close()
+
+			db, err = Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			check(db)
+			db.Close()
+
+			for _, name := range dataFileNames(dir) {
+				os.Remove(name + ".hint")
+			}
+			db, err = Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			check(db)
+		})
+	}
+}
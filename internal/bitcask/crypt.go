@@ -0,0 +1,176 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	nonceSize = 12
+	tagSize   = 16
+)
+
+// keyCheckFile holds a known plaintext sealed with the encryption key of
+// the store, so that Open can reject a wrong key before reading any data.
+// While RotateKey switches keys it holds one record per key.
+const keyCheckFile = ".bitcask.key"
+
+var keyCheck = []byte("bitcask")
+
+// keyCheckSize is the size of a record of the key check file.
+var keyCheckSize = nonceSize + len(keyCheck) + tagSize
+
+// ErrEncryptionKey is returned by Open when the store is encrypted with a
+// different key or when no key is given for an encrypted store.
+var ErrEncryptionKey = errors.New("wrong or missing encryption key")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal appends a fresh nonce and the sealed plaintext to buf. The header
+// is authenticated but not encrypted.
+func seal(buf *bytes.Buffer, aead cipher.AEAD, header, plaintext []byte) error {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	buf.Write(nonce)
+	buf.Write(aead.Seal(nil, nonce, plaintext, header))
+	return nil
+}
+
+// unseal reads a nonce and n sealed bytes from buf and returns the
+// plaintext.
+func unseal(buf *bytes.Buffer, aead cipher.AEAD, header []byte, n int) ([]byte, error) {
+	if aead == nil {
+		return nil, errors.New("encrypted entry without a key")
+	}
+	if buf.Len() < nonceSize+n+tagSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	nonce := buf.Next(nonceSize)
+	plain, err := aead.Open(nil, nonce, buf.Next(n+tagSize), header)
+	if err != nil {
+		return nil, errors.New("Authentication error reading entry")
+	}
+	return plain, nil
+}
+
+// checkKey verifies aead against the key check file of the store in dir,
+// creating the file for a store that is encrypted for the first time
+// unless readOnly is set. It returns true when the file accepts another
+// key as well, as left by a RotateKey that did not finish.
+func checkKey(dir string, aead cipher.AEAD, perm os.FileMode, readOnly bool) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, keyCheckFile))
+	if os.IsNotExist(err) {
+		if aead == nil || readOnly {
+			return false, nil
+		}
+		return false, writeKeyCheck(dir, perm, aead)
+	}
+	if err != nil {
+		return false, err
+	}
+	if aead == nil {
+		return false, ErrEncryptionKey
+	}
+	for off := 0; off+keyCheckSize <= len(data); off += keyCheckSize {
+		plain, err := unseal(bytes.NewBuffer(data[off:off+keyCheckSize]), aead, nil, len(keyCheck))
+		if err == nil && bytes.Equal(plain, keyCheck) {
+			return len(data) > keyCheckSize, nil
+		}
+	}
+	return false, ErrEncryptionKey
+}
+
+// writeKeyCheck replaces the key check file of the store in dir with one
+// accepting each of aeads, removing it when they are all nil.
+func writeKeyCheck(dir string, perm os.FileMode, aeads ...cipher.AEAD) error {
+	name := filepath.Join(dir, keyCheckFile)
+	var buf bytes.Buffer
+	for _, aead := range aeads {
+		if aead == nil {
+			continue
+		}
+		if err := seal(&buf, aead, nil, keyCheck); err != nil {
+			return err
+		}
+	}
+	if buf.Len() == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return syncDir(dir)
+	}
+	return replaceFile(name, perm, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
+
+// RotateKey rewrites every live entry of the store with key through a
+// merge and makes key the encryption key for new writes. A nil key
+// stores the entries unencrypted. Writes are blocked while the entries
+// are rewritten. Should the process stop before RotateKey returns, Open
+// accepts either key until one of them opens the store. When one side of
+// the switch is unencrypted, only the other key is accepted, and it reads
+// the unencrypted entries too.
+func (db *Bitcask) RotateKey(key []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	var aead cipher.AEAD
+	if key != nil {
+		var err error
+		if aead, err = newAEAD(key); err != nil {
+			return err
+		}
+	}
+	if err := db.lockMerge(); err != nil {
+		return err
+	}
+	defer db.unlockMerge()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Start a new active file so that the merge rewrites every entry.
+	if err := db.rotate(); err != nil {
+		return err
+	}
+	job := db.planMerge(MergePolicy{})
+	if err := db.copyMerge(context.Background(), job, aead); err != nil {
+		return db.abortMerge(job, err)
+	}
+	// The manifest switches to the files sealed with the new key in one
+	// write, so the key check accepts both keys across it.
+	if err := writeKeyCheck(db.directory, db.config.filePerm, db.aead, aead); err != nil {
+		return db.abortMerge(job, err)
+	}
+	if err := db.swapMerge(job); err != nil {
+		if err != errMergeCrashed {
+			writeKeyCheck(db.directory, db.config.filePerm, db.aead)
+		}
+		return db.abortMerge(job, err)
+	}
+	db.aead = aead
+	if crashed("key") {
+		return errMergeCrashed
+	}
+	if err := writeKeyCheck(db.directory, db.config.filePerm, aead); err != nil {
+		return err
+	}
+	return db.removeMerged(job)
+}
@@ -0,0 +1,201 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// containsPlaintext returns true if any data or hint file in dir contains s.
+func containsPlaintext(dir, s string) bool {
+	names, _ := filepath.Glob(filepath.Join(dir, "*.bitcask.data*"))
+	for _, name := range names {
+		data, _ := ioutil.ReadFile(name)
+		if bytes.Contains(data, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{7}, 32)
+	opts := []Option{WithEncryptionKey(key), WithChunkSize(16), WithAutoMerge(false)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	large := strings.Repeat("confidential", 10)
+	db.Put("secret-key", "secret-value")
+	db.Put("large-key", large)
+	db.Put("deleted-key", "deleted-value")
+	db.Delete("deleted-key")
+	b := NewBatch()
+	b.Put("batch-key", "batch-value")
+	db.Write(b)
+	db.Close()
+
+	for _, s := range []string{"secret", "confidential", "deleted", "batch"} {
+		if containsPlaintext(dir, s) {
+			t.Errorf("expected %q to be encrypted", s)
+		}
+	}
+
+	expected := map[string]string{
+		"secret-key": "secret-value",
+		"large-key":  large,
+		"batch-key":  "batch-value",
+	}
+	check := func(db *Bitcask) {
+		for k, v := range expected {
+			if _, got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("expected %v but got %v (%v)", v, got, err)
+			}
+		}
+		if db.HasKey("deleted-key") {
+			t.Errorf("expected deleted key to be missing")
+		}
+	}
+	for _, hints := range []bool{true, false} {
+		if !hints {
+			for _, name := range dataFileNames(dir) {
+				os.Remove(name + ".hint")
+			}
+		}
+		db, err = Open(dir, opts...)
+		if err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		check(db)
+		db.Close()
+	}
+
+	wrong := map[string][]Option{
+		"no key":    nil,
+		"wrong key": {WithEncryptionKey(bytes.Repeat([]byte{8}, 32))},
+	}
+	for name, opts := range wrong {
+		if _, err := Open(dir, opts...); !errors.Is(err, ErrEncryptionKey) {
+			t.Errorf("%s: expected %v but got %v", name, ErrEncryptionKey, err)
+		}
+	}
+
+	// Tampering with a record fails its authentication, and with its
+	// unused crc field the check that it is zero.
+	names := dataFileNames(dir)
+	os.Remove(names[0] + ".hint")
+	os.Remove(filepath.Join(dir, checkpointFile))
+	backup, _ := ioutil.ReadFile(names[0])
+	for name, off := range map[string]int{"record": len(backup) / 2, "crc": fileHeaderSize} {
+		data := append([]byte(nil), backup...)
+		data[off] ^= 0xff
+		ioutil.WriteFile(names[0], data, 0644)
+		if _, err := Open(dir, opts...); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected %v but got %v", name, ErrCorrupt, err)
+		}
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("secret-key", "secret-value")
+	db.PutWithTTL("expiring-key", "expiring-value", time.Hour)
+
+	keys := [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32), nil}
+	for i, key := range keys {
+		if err := db.RotateKey(key); err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		db.Put("after", "rotation")
+		db.Close()
+
+		if encrypted := !containsPlaintext(dir, "secret"); encrypted != (key != nil) {
+			t.Errorf("rotation %d: expected encrypted %t", i, key != nil)
+		}
+		if key != nil && i > 0 {
+			if _, err := Open(dir, WithEncryptionKey(keys[i-1])); !errors.Is(err, ErrEncryptionKey) {
+				t.Errorf("rotation %d: expected %v but got %v", i, ErrEncryptionKey, err)
+			}
+		}
+		db, err = Open(dir, WithEncryptionKey(key), WithAutoMerge(false))
+		if err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		for k, v := range map[string]string{"secret-key": "secret-value", "expiring-key": "expiring-value", "after": "rotation"} {
+			if _, got, _ := db.Get(k); got != v {
+				t.Errorf("rotation %d: expected %v but got %v", i, v, got)
+			}
+		}
+	}
+	db.Close()
+}
+
+func TestRotateKeyCrash(t *testing.T) {
+	defer func() { mergeCrash = nil }()
+	old, key := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32)
+	// The store switches to the new key with the manifest.
+	steps := map[string]bool{"copy": false, "sync": false, "manifest": true, "key": true, "remove": true}
+	for step, switched := range steps {
+		t.Run(step, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(dir, WithAutoMerge(false), WithEncryptionKey(old))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			db.Put("secret-key", "secret-value")
+			mergeCrash = func(s string) bool { return s == step }
+			if err := db.RotateKey(key); err != errMergeCrashed {
+				t.Fatalf("expected %v but got %v", errMergeCrashed, err)
+			}
+			mergeCrash = nil
+			crash(db)
+
+			good, bad := old, key
+			if switched {
+				good, bad = key, old
+			}
+			if db, err := Open(dir, WithAutoMerge(false), WithEncryptionKey(bad)); err == nil {
+				db.Close()
+				t.Fatalf("expected an error opening with the other key")
+			}
+			db, err = Open(dir, WithAutoMerge(false), WithEncryptionKey(good))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			if _, got, _ := db.Get("secret-key"); got != "secret-value" {
+				t.Errorf("expected %v but got %v", "secret-value", got)
+			}
+			db.Close()
+			// Opening the store settles the switch.
+			if _, err := Open(dir, WithEncryptionKey(bad)); !errors.Is(err, ErrEncryptionKey) {
+				t.Errorf("expected %v but got %v", ErrEncryptionKey, err)
+			}
+		})
+	}
+}
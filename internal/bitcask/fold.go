@@ -0,0 +1,109 @@
+package bitcask
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrStopIteration can be returned by the function passed to Fold or
+// ForEachKey to stop the iteration without an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// Fold calls fn for every live key with its value, reading the data files
+// in order instead of looking up each key. db.mu is only held to check
+// that an entry is still live, so writes are not blocked during the walk.
+// Keys written or moved by a merge after Fold starts may be missed.
+// Returning ErrStopIteration from fn stops the walk and Fold returns nil;
+// any other error is returned.
+func (db *Bitcask) Fold(fn func(key string, value []byte) error) error {
+	db.mu.RLock()
+	files := make([]*dataFile, 0, len(db.order))
+	for _, id := range db.order {
+		files = append(files, db.dataFiles[id])
+	}
+	db.mu.RUnlock()
+	for _, df := range files {
+		if err := db.foldFile(df, fn); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// foldFile calls fn for the live entries of df. The file is opened only
+// when the walk reaches it. A file removed by a merge since the walk
+// started is skipped, as the keydir no longer points to its entries.
+func (db *Bitcask) foldFile(df *dataFile, fn func(key string, value []byte) error) error {
+	db.mu.RLock()
+	it, err := newDataFileIter(df, db.aead)
+	db.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.HasNext() {
+		kd, value, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if !db.live(kd) {
+			continue
+		}
+		if err := fn(string(kd.key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// live returns true if the keydir still points to the entry kd read from
+// a data file.
+func (db *Bitcask) live(kd *keyDirEntry) bool {
+	if kd.tombstone() || kd.flags&flagCommit != 0 {
+		return false
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	cur, ok := db.lookup(string(kd.key))
+	return ok && cur.sameRecord(kd)
+}
+
+// ForEachKey calls fn for every live key in ascending order. db.mu is
+// held only while looking up the next key. Returning ErrStopIteration from
+// fn stops the walk and ForEachKey returns nil; any other error is
+// returned.
+func (db *Bitcask) ForEachKey(fn func(key string) error) error {
+	seek := ""
+	for {
+		key, ok := db.nextKey(seek)
+		if !ok {
+			return nil
+		}
+		if err := fn(key); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+		seek = key + "\x00"
+	}
+}
+
+// nextKey returns the first live key not less than seek.
+func (db *Bitcask) nextKey(seek string) (string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	now := unixNow()
+	for n := db.index.seek(seek); n != skipEnd; n = db.index.next(n) {
+		if kd := db.keyDir.at(n); !kd.expired(now) {
+			return string(kd.key), true
+		}
+	}
+	return "", false
+}
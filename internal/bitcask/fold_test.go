@@ -0,0 +1,181 @@
+package bitcask
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithChunkSize(8), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "old")
+	db.Put("b", "value")
+	db.Close()
+	db, err = Open(dir, WithChunkSize(8), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	db.Put("a", "new")
+	db.Put("large", strings.Repeat("x", 30))
+	db.Put("c", "gone")
+	db.Delete("c")
+	b := NewBatch()
+	b.Put("d", "batch")
+	db.Write(b)
+
+	want := map[string]string{
+		"a":     "new",
+		"b":     "value",
+		"large": strings.Repeat("x", 30),
+		"d":     "batch",
+	}
+	fold := func() map[string]string {
+		got := make(map[string]string)
+		err := db.Fold(func(key string, value []byte) error {
+			if _, ok := got[key]; ok {
+				t.Errorf("key %s seen twice", key)
+			}
+			got[key] = string(value)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Non expected error: %s", err.Error())
+		}
+		return got
+	}
+	if got := fold(); !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if got := fold(); !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	var keys []string
+	db.ForEachKey(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if w := []string{"a", "b", "d", "large"}; !reflect.DeepEqual(w, keys) {
+		t.Errorf("expected %v but got %v", w, keys)
+	}
+}
+
+func TestFoldStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		db.Put(k, k)
+	}
+
+	failed := errors.New("failed")
+	tests := map[string]struct {
+		err  error
+		want error
+	}{
+		"stop":  {ErrStopIteration, nil},
+		"error": {failed, failed},
+	}
+	for name, tt := range tests {
+		n := 0
+		err := db.Fold(func(key string, value []byte) error {
+			n++
+			return tt.err
+		})
+		if err != tt.want || n != 1 {
+			t.Errorf("%s: expected %v after 1 key but got %v after %d", name, tt.want, err, n)
+		}
+		n = 0
+		err = db.ForEachKey(func(key string) error {
+			n++
+			return tt.err
+		})
+		if err != tt.want || n != 1 {
+			t.Errorf("%s: expected %v after 1 key but got %v after %d", name, tt.want, err, n)
+		}
+	}
+}
+
+func TestFoldConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		db.Put(k, k)
+	}
+	n := 0
+	err = db.Fold(func(key string, value []byte) error {
+		// Writing from fn must not deadlock.
+		n++
+		return db.Put("new-"+key, "value")
+	})
+	if err != nil || n != 3 {
+		t.Errorf("expected 3 keys but got %d: %v", n, err)
+	}
+}
+
+func TestFoldDuringMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithMaxFileSize(64), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	want := fillMergeStore(db)
+	merged := false
+	err = db.Fold(func(key string, value []byte) error {
+		// The files the walk has not reached yet are removed.
+		if !merged {
+			merged = true
+			if err := db.Merge(); err != nil {
+				return err
+			}
+		}
+		if string(value) != want[key] {
+			t.Errorf("%s: expected %v but got %s", key, want[key], value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Non expected error: %s", err.Error())
+	}
+	checkMergeStore(t, db, want)
+}
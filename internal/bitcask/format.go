@@ -0,0 +1,204 @@
+package bitcask
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// format is the version of the on-disk layout of a data file and its hint
+// file.
+type format uint16
+
+const (
+	// formatV0 files have no file header and store the timestamps of the
+	// entries as uint32 seconds.
+	formatV0 format = iota
+	// formatV1 files start with a file header and store the timestamps of
+	// the entries as int64 nanoseconds.
+	formatV1
+)
+
+// currentFormat is the format of the files written by this version.
+const currentFormat = formatV1
+
+// File headers are laid out as magic(4) | version(2) | flags(2) | file id(8).
+// The file id ties a hint file to its data file.
+const (
+	fileMagic      = 0x6263736b // "bcsk"
+	fileHeaderSize = 16
+)
+
+// File flags are stored in the file header.
+const (
+	// fileHint marks a hint file.
+	fileHint uint16 = 1 << iota
+	// fileManifest marks the manifest.
+	fileManifest
+	// fileCheckpoint marks the keydir checkpoint.
+	fileCheckpoint
+)
+
+// ErrUnsupportedFormat is returned by Open when a data or hint file was
+// written in a format this version cannot read.
+var ErrUnsupportedFormat = errors.New("unsupported data file format")
+
+// timestampSize returns the size of an entry timestamp.
+func (f format) timestampSize() int {
+	if f == formatV0 {
+		return 4
+	}
+	return 8
+}
+
+// headerSize returns the size of the fixed part of an entry header:
+// crc | timestamp | flags<<24|ksz | vsz. The crc of an encrypted entry is
+// zero.
+func (f format) headerSize() int {
+	return 12 + f.timestampSize()
+}
+
+// hintHeaderSize returns the size of the fixed part of a hint record:
+// timestamp | flags<<24|ksz | valueSz | valuePos.
+func (f format) hintHeaderSize() int {
+	return 16 + f.timestampSize()
+}
+
+// fileHeaderLen returns the size of the file header, which v0 files lack.
+func (f format) fileHeaderLen() int64 {
+	if f == formatV0 {
+		return 0
+	}
+	return fileHeaderSize
+}
+
+// headerLen returns the size of an entry header with the given flags.
+func (f format) headerLen(flags uint8) int {
+	n := f.headerSize()
+	if flags&flagExpiry != 0 {
+		n += expirySize
+	}
+	if flags&flagVersion != 0 {
+		n += versionSize
+	}
+	if flags&flagEncrypted != 0 {
+		n += nonceSize
+	}
+	return n
+}
+
+// recordLen returns the size of an entry with the given flags and sizes.
+func (f format) recordLen(flags uint8, ksz, vsz uint32) int64 {
+	n := int64(f.headerLen(flags)) + int64(ksz) + int64(vsz)
+	if flags&flagEncrypted != 0 {
+		n += tagSize
+	}
+	return n
+}
+
+// hintRecordLen returns the size of a hint record with the given flags
+// and key size.
+func (f format) hintRecordLen(flags uint8, ksz uint32) int {
+	n := f.hintHeaderSize() + int(ksz)
+	if flags&flagExpiry != 0 {
+		n += expirySize
+	}
+	if flags&flagVersion != 0 {
+		n += versionSize
+	}
+	if flags&flagEncrypted != 0 {
+		n += nonceSize + tagSize
+	}
+	return n
+}
+
+// writeTimestamp appends the timestamp of an entry, given in nanoseconds.
+func (f format) writeTimestamp(w io.Writer, ts int64) {
+	if f == formatV0 {
+		binary.Write(w, binary.BigEndian, uint32(ts/int64(1e9)))
+		return
+	}
+	binary.Write(w, binary.BigEndian, ts)
+}
+
+// readTimestamp reads the timestamp of an entry in nanoseconds.
+func (f format) readTimestamp(r io.Reader) (int64, error) {
+	if f == formatV0 {
+		var ts uint32
+		err := binary.Read(r, binary.BigEndian, &ts)
+		return int64(ts) * 1e9, err
+	}
+	var ts int64
+	err := binary.Read(r, binary.BigEndian, &ts)
+	return ts, err
+}
+
+// fileHeader returns the header of a file with the given id and flags in
+// the current format.
+func fileHeader(id int64, flags uint16) []byte {
+	h := make([]byte, fileHeaderSize)
+	binary.BigEndian.PutUint32(h[0:4], fileMagic)
+	binary.BigEndian.PutUint16(h[4:6], uint16(currentFormat))
+	binary.BigEndian.PutUint16(h[6:8], flags)
+	binary.BigEndian.PutUint64(h[8:16], uint64(id))
+	return h
+}
+
+// readFileHeader returns the format of the file f with the given id and
+// flags. A file without a header is a v0 file.
+func readFileHeader(f *os.File, id int64, flags uint16) (format, error) {
+	h := make([]byte, fileHeaderSize)
+	n, err := f.ReadAt(h, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if n < fileHeaderSize || binary.BigEndian.Uint32(h[0:4]) != fileMagic {
+		return formatV0, nil
+	}
+	v := format(binary.BigEndian.Uint16(h[4:6]))
+	if v == formatV0 || v > currentFormat {
+		return 0, fmt.Errorf("%w: %s: version %d", ErrUnsupportedFormat, f.Name(), v)
+	}
+	if got := binary.BigEndian.Uint16(h[6:8]); got != flags {
+		return 0, fmt.Errorf("%w: %s: unexpected file flags %#x", ErrCorrupt, f.Name(), got)
+	}
+	if got := int64(binary.BigEndian.Uint64(h[8:16])); got != id {
+		return 0, fmt.Errorf("%w: %s: belongs to file %d", ErrCorrupt, f.Name(), got)
+	}
+	return v, nil
+}
+
+// Migrate rewrites the data files of the store at path that use an older
+// format in the current one and returns how many files it found. The
+// store must not be open.
+func Migrate(path string, opts ...Option) (int, error) {
+	opts = append(opts[:len(opts):len(opts)], WithAutoMerge(false))
+	db, err := Open(path, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	if err := db.lockMerge(); err != nil {
+		return 0, err
+	}
+	defer db.unlockMerge()
+
+	db.mu.RLock()
+	legacy := 0
+	for _, df := range db.dataFiles {
+		if df.format != currentFormat {
+			legacy++
+		}
+	}
+	db.mu.RUnlock()
+	if legacy == 0 {
+		return 0, nil
+	}
+	// Open started a new active file, so the merge rewrites every entry.
+	_, err = db.merge(context.Background(), MergeOptions{})
+	return legacy, err
+}
@@ -0,0 +1,164 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func legacyEntry(key, value string, ts int64) *entry {
+	return &entry{
+		timestamp: ts * 1e9,
+		ksz:       uint32(len(key)),
+		vsz:       uint32(len(value)),
+		key:       []byte(key),
+		value:     []byte(value),
+	}
+}
+
+// writeLegacyFile writes es to a v0 data file, with its hint file when
+// hint is set.
+func writeLegacyFile(dir string, id int64, hint bool, es ...*entry) {
+	var data, hints bytes.Buffer
+	for _, e := range es {
+		pos := int64(data.Len())
+		encode(&data, e, formatV0, nil)
+		kd := keyDirEntry{
+			fileID:    id,
+			valueSz:   e.vsz,
+			valuePos:  pos + int64(formatV0.headerLen(e.flags)+int(e.ksz)),
+			timestamp: e.timestamp,
+			flags:     e.flags,
+			format:    formatV0,
+			key:       e.key,
+		}
+		encodeKeyEntry(&hints, &kd, nil)
+	}
+	name := dataFilePath(dir, id)
+	if err := ioutil.WriteFile(name, data.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if hint {
+		if err := ioutil.WriteFile(name+".hint", hints.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeLegacyFile(dir, 1, false, legacyEntry("a", "1", 100), legacyEntry("b", "1", 100))
+	writeLegacyFile(dir, 2, true, legacyEntry("a", "2", 200), legacyEntry("b", "", 200),
+		legacyEntry("c", "3", 200))
+
+	expected := map[string]string{"a": "2", "b": "", "c": "3", "d": "4"}
+	check := func(db *Bitcask) {
+		for k, v := range expected {
+			if _, got, _ := db.Get(k); got != v {
+				t.Errorf("expected %v but got %v", v, got)
+			}
+		}
+		if db.HasKey("b") {
+			t.Errorf("expected deleted key to be missing")
+		}
+		if kd, _ := db.keyDir.get("a"); kd.timestamp != 200*1e9 {
+			t.Errorf("expected %v but got %v", int64(200*1e9), kd.timestamp)
+		}
+	}
+
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if f := db.dataFiles[1].format; f != formatV0 {
+		t.Errorf("expected %v but got %v", formatV0, f)
+	}
+	db.Put("d", "4")
+	check(db)
+	db.Close()
+
+	for _, want := range []int{2, 0} {
+		n, err := Migrate(dir)
+		if err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		if n != want {
+			t.Errorf("expected %d but got %d", want, n)
+		}
+	}
+
+	db, err = Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	for id, df := range db.dataFiles {
+		if df.format != currentFormat {
+			t.Errorf("file %d: expected %v but got %v", id, currentFormat, df.format)
+		}
+	}
+	check(db)
+}
+
+func TestFileHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without a checkpoint, Open reads the hint files.
+	db, err := Open(dir, WithCheckpointInterval(0))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "1")
+	db.rotate()
+	db.Put("b", "2")
+	db.Close()
+	names := dataFileNames(dir)
+
+	tests := map[string]struct {
+		corrupt func()
+		err     error
+	}{
+		"hint of another file": {
+			corrupt: func() {
+				data, _ := ioutil.ReadFile(names[0] + ".hint")
+				ioutil.WriteFile(names[1]+".hint", data, 0644)
+			},
+			err: ErrCorrupt,
+		},
+		"newer version": {
+			corrupt: func() {
+				data, _ := ioutil.ReadFile(names[0])
+				binary.BigEndian.PutUint16(data[4:6], uint16(currentFormat+1))
+				ioutil.WriteFile(names[0], data, 0644)
+			},
+			err: ErrUnsupportedFormat,
+		},
+	}
+	for name, tt := range tests {
+		backup := map[string][]byte{}
+		for _, n := range names {
+			backup[n], _ = ioutil.ReadFile(n)
+			backup[n+".hint"], _ = ioutil.ReadFile(n + ".hint")
+		}
+		tt.corrupt()
+		if _, err := Open(dir); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v but got %v", name, tt.err, err)
+		}
+		for n, data := range backup {
+			ioutil.WriteFile(n, data, 0644)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package bitcask
+
+import "unsafe"
+
+const (
+	// slabSize is the size of the arena slabs holding the keys. A larger
+	// key gets a slab of its own.
+	slabSize = 1 << 20
+	// freeSlab marks an unused slot of keyDir.entries.
+	freeSlab = ^uint32(0)
+)
+
+// KeyDirMemory accounts the memory held by the keydir.
+type KeyDirMemory struct {
+	Keys int
+	// KeyBytes is the size of the live keys. ArenaBytes is the size of
+	// the slabs holding them, including the keys deleted since the last
+	// compaction and the room left for new keys.
+	KeyBytes   int64
+	ArenaBytes int64
+	// EntryBytes is the size of the entries locating the values,
+	// TableBytes the size of the hash table and IndexBytes the size of
+	// the ordered index of the keys.
+	EntryBytes int64
+	TableBytes int64
+	IndexBytes int64
+}
+
+// Total returns the memory held by the keydir.
+func (m KeyDirMemory) Total() int64 {
+	return m.ArenaBytes + m.EntryBytes + m.TableBytes + m.IndexBytes
+}
+
+// KeyDirMemory returns the memory held by the keydir.
+func (db *Bitcask) KeyDirMemory() KeyDirMemory {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	m := db.keyDir.memory()
+	m.IndexBytes = db.index.memory()
+	return m
+}
+
+// dirEntry is the packed form of a keyDirEntry. Its key is stored in a
+// slab of the arena and its file id in the file table. It holds no
+// pointers, so the garbage collector does not scan the entries.
+type dirEntry struct {
+	valuePos  int64
+	timestamp int64
+	version   uint64
+	hash      uint32
+	slab      uint32
+	off       uint32
+	ksz       uint32
+	file      uint32
+	valueSz   uint32
+	expiry    uint32
+	format    format
+	flags     uint8
+}
+
+// keyDir maps every key to the entry of its latest value. The keys are
+// stored once, in append-only slabs, and looked up through an open
+// addressing hash table of entry numbers. The bytes of a key are never
+// overwritten, so the key of a keyDirEntry returned by the keydir stays
+// valid after the key is removed. It is not safe for concurrent use.
+type keyDir struct {
+	entries []dirEntry
+	// free holds the unused slots of entries.
+	free []uint32
+	// table holds the entry number plus one of every key, or zero.
+	table []uint32
+	slabs [][]byte
+	// files maps the small file numbers of the entries to file ids.
+	files    []int64
+	fileNums map[int64]uint32
+	n        int
+	// liveKeys and deadKeys are the sizes of the keys in the slabs that
+	// are still in use and that were removed.
+	liveKeys int64
+	deadKeys int64
+}
+
+func newKeyDir() *keyDir {
+	return &keyDir{
+		table:    make([]uint32, 16),
+		fileNums: make(map[int64]uint32),
+	}
+}
+
+// hashKey returns the 32-bit folded FNV-1a hash of key.
+func hashKey(key string) uint32 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return uint32(h ^ h>>32)
+}
+
+func (kd *keyDir) len() int {
+	return kd.n
+}
+
+// key returns the key of e in the arena.
+func (kd *keyDir) key(e *dirEntry) []byte {
+	end := e.off + e.ksz
+	return kd.slabs[e.slab][e.off:end:end]
+}
+
+// find returns the slot of the table holding key, or the empty slot where
+// it belongs, and its entry number.
+func (kd *keyDir) find(key string, h uint32) (int, uint32, bool) {
+	mask := len(kd.table) - 1
+	for i := int(h) & mask; ; i = (i + 1) & mask {
+		v := kd.table[i]
+		if v == 0 {
+			return i, 0, false
+		}
+		e := &kd.entries[v-1]
+		if e.hash == h && string(kd.key(e)) == key {
+			return i, v - 1, true
+		}
+	}
+}
+
+// at returns the entry with number i.
+func (kd *keyDir) at(i uint32) keyDirEntry {
+	e := &kd.entries[i]
+	return keyDirEntry{
+		fileID:    kd.files[e.file],
+		valueSz:   e.valueSz,
+		valuePos:  e.valuePos,
+		timestamp: e.timestamp,
+		flags:     e.flags,
+		format:    e.format,
+		expiry:    e.expiry,
+		version:   e.version,
+		key:       kd.key(e),
+	}
+}
+
+// get returns the entry of key.
+func (kd *keyDir) get(key string) (keyDirEntry, bool) {
+	_, i, ok := kd.find(key, hashKey(key))
+	if !ok {
+		return keyDirEntry{}, false
+	}
+	return kd.at(i), true
+}
+
+// put records e as the entry of its key and returns the entry number. It
+// returns the previous entry of the key if there was one.
+func (kd *keyDir) put(e keyDirEntry) (keyDirEntry, uint32, bool) {
+	k := string(e.key)
+	h := hashKey(k)
+	slot, i, ok := kd.find(k, h)
+	if ok {
+		old := kd.at(i)
+		kd.pack(i, &e)
+		return old, i, true
+	}
+	if (kd.n+1)*4 > len(kd.table)*3 {
+		kd.grow()
+		slot, _, _ = kd.find(k, h)
+	}
+	if n := len(kd.free); n > 0 {
+		i = kd.free[n-1]
+		kd.free = kd.free[:n-1]
+	} else {
+		i = uint32(len(kd.entries))
+		kd.entries = append(kd.entries, dirEntry{})
+	}
+	kd.entries[i].hash = h
+	kd.entries[i].slab, kd.entries[i].off = kd.alloc(e.key)
+	kd.entries[i].ksz = uint32(len(e.key))
+	kd.pack(i, &e)
+	kd.table[slot] = i + 1
+	kd.n++
+	kd.liveKeys += int64(len(e.key))
+	return keyDirEntry{}, i, false
+}
+
+// pack stores the location of e in the entry with number i, which
+// already holds its key.
+func (kd *keyDir) pack(i uint32, e *keyDirEntry) {
+	d := &kd.entries[i]
+	d.valuePos = e.valuePos
+	d.timestamp = e.timestamp
+	d.version = e.version
+	d.file = kd.fileNum(e.fileID)
+	d.valueSz = e.valueSz
+	d.expiry = e.expiry
+	d.format = e.format
+	d.flags = e.flags
+}
+
+// remove drops key and returns its entry.
+func (kd *keyDir) remove(key string) (keyDirEntry, bool) {
+	slot, i, ok := kd.find(key, hashKey(key))
+	if !ok {
+		return keyDirEntry{}, false
+	}
+	old := kd.at(i)
+	kd.unlink(slot)
+	kd.liveKeys -= int64(kd.entries[i].ksz)
+	kd.deadKeys += int64(kd.entries[i].ksz)
+	kd.entries[i] = dirEntry{slab: freeSlab}
+	kd.free = append(kd.free, i)
+	kd.n--
+	return old, true
+}
+
+// unlink empties slot, moving back the following keys of its cluster that
+// could no longer be found.
+func (kd *keyDir) unlink(slot int) {
+	mask := len(kd.table) - 1
+	i := slot
+	for j := (i + 1) & mask; kd.table[j] != 0; j = (j + 1) & mask {
+		home := int(kd.entries[kd.table[j]-1].hash) & mask
+		if (j > i && (home <= i || home > j)) || (j < i && home <= i && home > j) {
+			kd.table[i] = kd.table[j]
+			i = j
+		}
+	}
+	kd.table[i] = 0
+}
+
+// grow doubles the hash table.
+func (kd *keyDir) grow() {
+	table := make([]uint32, len(kd.table)*2)
+	mask := len(table) - 1
+	for i := range kd.entries {
+		e := &kd.entries[i]
+		if e.slab == freeSlab {
+			continue
+		}
+		j := int(e.hash) & mask
+		for table[j] != 0 {
+			j = (j + 1) & mask
+		}
+		table[j] = uint32(i) + 1
+	}
+	kd.table = table
+}
+
+// alloc copies key to the arena and returns where it landed. When more
+// than half of the arena holds removed keys, the live keys are first
+// compacted into new slabs.
+func (kd *keyDir) alloc(key []byte) (uint32, uint32) {
+	if kd.deadKeys > kd.liveKeys && kd.deadKeys >= slabSize {
+		kd.compact()
+	}
+	n := len(kd.slabs)
+	if len(key) > slabSize {
+		kd.slabs = append(kd.slabs, append([]byte(nil), key...))
+		return uint32(n), 0
+	}
+	if n == 0 || len(kd.slabs[n-1])+len(key) > cap(kd.slabs[n-1]) {
+		kd.slabs = append(kd.slabs, make([]byte, 0, slabSize))
+		n++
+	}
+	off := len(kd.slabs[n-1])
+	kd.slabs[n-1] = append(kd.slabs[n-1], key...)
+	return uint32(n - 1), uint32(off)
+}
+
+// compact copies the live keys to new slabs. The old slabs are left to
+// the keyDirEntry values still referring to them.
+func (kd *keyDir) compact() {
+	old := kd.slabs
+	kd.slabs = nil
+	kd.deadKeys = 0
+	for i := range kd.entries {
+		e := &kd.entries[i]
+		if e.slab == freeSlab {
+			continue
+		}
+		end := e.off + e.ksz
+		e.slab, e.off = kd.alloc(old[e.slab][e.off:end])
+	}
+}
+
+// snapshot returns a copy of kd that shares its slabs, which are never
+// overwritten, and can be read while kd keeps changing. It has no hash
+// table, so it can only be walked.
+func (kd *keyDir) snapshot() *keyDir {
+	return &keyDir{
+		entries:  append([]dirEntry(nil), kd.entries...),
+		slabs:    append([][]byte(nil), kd.slabs...),
+		files:    append([]int64(nil), kd.files...),
+		n:        kd.n,
+		liveKeys: kd.liveKeys,
+	}
+}
+
+// fileNum returns the small number standing for the file id.
+func (kd *keyDir) fileNum(id int64) uint32 {
+	if n, ok := kd.fileNums[id]; ok {
+		return n
+	}
+	n := uint32(len(kd.files))
+	kd.files = append(kd.files, id)
+	kd.fileNums[id] = n
+	return n
+}
+
+// each calls fn with every entry until it returns false. fn may remove
+// entries.
+func (kd *keyDir) each(fn func(e keyDirEntry) bool) {
+	for i := range kd.entries {
+		if kd.entries[i].slab == freeSlab {
+			continue
+		}
+		if !fn(kd.at(uint32(i))) {
+			return
+		}
+	}
+}
+
+func (kd *keyDir) memory() KeyDirMemory {
+	m := KeyDirMemory{
+		Keys:       kd.n,
+		KeyBytes:   kd.liveKeys,
+		EntryBytes: int64(cap(kd.entries))*int64(unsafe.Sizeof(dirEntry{})) + int64(cap(kd.free))*4,
+		TableBytes: int64(cap(kd.table)) * 4,
+	}
+	for _, s := range kd.slabs {
+		m.ArenaBytes += int64(cap(s))
+	}
+	// The file table and an estimate of its map.
+	m.EntryBytes += int64(cap(kd.files))*8 + int64(len(kd.fileNums))*16
+	return m
+}
@@ -0,0 +1,113 @@
+package bitcask
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyDir(t *testing.T) {
+	kd := newKeyDir()
+	want := map[string]keyDirEntry{}
+	rnd := rand.New(rand.NewSource(1))
+	// Long keys so that the removed ones fill more than a slab and get
+	// compacted away.
+	pad := strings.Repeat("k", 200)
+	for i := 0; i < 100000; i++ {
+		k := fmt.Sprintf("%s%d", pad, rnd.Intn(20000))
+		if rnd.Intn(3) == 0 {
+			_, ok := kd.remove(k)
+			if _, exists := want[k]; ok != exists {
+				t.Fatalf("%s: expected removed %t but got %t", k, exists, ok)
+			}
+			delete(want, k)
+			continue
+		}
+		e := keyDirEntry{
+			fileID:    int64(rnd.Intn(50)) + 1e12,
+			valuePos:  int64(i),
+			valueSz:   uint32(i),
+			timestamp: int64(i) * 1e9,
+			version:   uint64(i),
+			format:    currentFormat,
+			key:       []byte(k),
+		}
+		old, _, ok := kd.put(e)
+		if prev, exists := want[k]; ok != exists || ok && !old.sameRecord(&prev) {
+			t.Fatalf("%s: expected previous %+v but got %+v", k, prev, old)
+		}
+		want[k] = e
+	}
+	if kd.len() != len(want) {
+		t.Errorf("expected %d keys but got %d", len(want), kd.len())
+	}
+	for k, e := range want {
+		got, ok := kd.get(k)
+		if !ok || string(got.key) != k || got.fileID != e.fileID || got.valuePos != e.valuePos ||
+			got.valueSz != e.valueSz || got.timestamp != e.timestamp || got.version != e.version {
+			t.Fatalf("%s: expected %+v but got %+v", k, e, got)
+		}
+	}
+	n := 0
+	kd.each(func(e keyDirEntry) bool {
+		if _, ok := want[string(e.key)]; !ok {
+			t.Errorf("unexpected key %s", e.key)
+		}
+		n++
+		return true
+	})
+	if n != len(want) {
+		t.Errorf("expected %d keys but got %d", len(want), n)
+	}
+	var size int64
+	for k := range want {
+		size += int64(len(k))
+	}
+	m := kd.memory()
+	if m.KeyBytes != size {
+		t.Errorf("expected %d key bytes but got %d", size, m.KeyBytes)
+	}
+	// The arena was compacted, so it holds little more than the live keys.
+	if m.ArenaBytes > 2*m.KeyBytes+2*slabSize {
+		t.Errorf("expected the arena to be compacted but got %+v", m)
+	}
+	if len(kd.files) != 50 {
+		t.Errorf("expected %d file numbers but got %d", 50, len(kd.files))
+	}
+}
+
+func TestKeyDirMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	if m := db.KeyDirMemory(); m.Keys != 0 || m.KeyBytes != 0 || m.IndexBytes != 0 {
+		t.Errorf("expected an empty keydir but got %+v", m)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Put(fmt.Sprintf("key%04d", i), "value")
+	}
+	db.Delete("key0000")
+	m := db.KeyDirMemory()
+	if m.Keys != 999 || m.KeyBytes != 999*7 {
+		t.Errorf("expected %d keys of %d bytes but got %+v", 999, 999*7, m)
+	}
+	if m.EntryBytes == 0 || m.TableBytes == 0 || m.IndexBytes == 0 || m.Total() < m.ArenaBytes+m.EntryBytes {
+		t.Errorf("unexpected memory %+v", m)
+	}
+	// The index takes a node and about one and a third links per key.
+	if m.IndexBytes > 1000*24 {
+		t.Errorf("expected at most %d index bytes but got %d", 1000*24, m.IndexBytes)
+	}
+}
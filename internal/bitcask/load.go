@@ -0,0 +1,184 @@
+package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// loadBufferSize is the size of the buffer a data or hint file is streamed
+// through while it is loaded.
+const loadBufferSize = 64 << 10
+
+// recordReader streams the records of a data or hint file, holding only
+// the record being decoded in memory.
+type recordReader struct {
+	r      *bufio.Reader
+	format format
+	hint   bool
+	left   int64
+}
+
+func newRecordReader(r io.Reader, size int64, f format, hint bool) *recordReader {
+	return &recordReader{
+		r:      bufio.NewReaderSize(r, loadBufferSize),
+		format: f,
+		hint:   hint,
+		left:   size,
+	}
+}
+
+// next reads the next record into buf, replacing its content, and returns
+// its size. It returns io.EOF after the last record and
+// io.ErrUnexpectedEOF for a record cut short.
+func (rr *recordReader) next(buf *bytes.Buffer) (int64, error) {
+	if rr.left == 0 {
+		return 0, io.EOF
+	}
+	f := rr.format
+	n := f.headerSize()
+	if rr.hint {
+		n = f.hintHeaderSize()
+	}
+	if int64(n) > rr.left {
+		return 0, io.ErrUnexpectedEOF
+	}
+	header, err := rr.r.Peek(n)
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	var size int64
+	if rr.hint {
+		ks := binary.BigEndian.Uint32(header[f.timestampSize():])
+		size = int64(f.hintRecordLen(uint8(ks>>flagShift), ks&kszMask))
+	} else {
+		sizes := header[4+f.timestampSize():]
+		ks := binary.BigEndian.Uint32(sizes[0:4])
+		size = f.recordLen(uint8(ks>>flagShift), ks&kszMask, binary.BigEndian.Uint32(sizes[4:8]))
+	}
+	if size > rr.left {
+		return 0, io.ErrUnexpectedEOF
+	}
+	buf.Reset()
+	buf.Grow(int(size))
+	if _, err := io.CopyN(buf, rr.r, size); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	rr.left -= size
+	return size, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// loadJob is a data file whose records from start are to be loaded into
+// the keydir. tail is set for a file a writer may still be appending to.
+type loadJob struct {
+	df    *dataFile
+	start int64
+	tail  bool
+}
+
+type loadResult struct {
+	entries []keyDirEntry
+	valid   int64
+	err     error
+}
+
+// loadFiles reads the jobs with a pool of workers and replays their
+// entries in the order of the jobs, which is the order the manifest lists
+// the files in, so that the last entry of a key wins as when the files are
+// read one by one. Workers run at most twice their number of files ahead
+// of the replay, which bounds the entries held in memory.
+func (db *Bitcask) loadFiles(jobs []loadJob, now uint32) error {
+	workers := db.config.loadParallelism
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = minInt(workers, len(jobs))
+
+	results := make([]chan loadResult, len(jobs))
+	for i := range results {
+		results[i] = make(chan loadResult, 1)
+	}
+	next := make(chan int)
+	ahead := make(chan struct{}, 2*workers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+		for _, j := range jobs {
+			if j.df.hr != nil {
+				j.df.hr.Close()
+				j.df.hr = nil
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] <- db.readLoadJob(jobs[i])
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(next)
+		for i := range jobs {
+			select {
+			case ahead <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case next <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i, j := range jobs {
+		r := <-results[i]
+		<-ahead
+		if j.tail && r.err == io.ErrUnexpectedEOF {
+			j.df.offset, r.err = r.valid, nil
+		}
+		if r.err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorrupt, j.df.name, r.err)
+		}
+		db.replay(r.entries, now)
+	}
+	return nil
+}
+
+// readLoadJob reads the entries of the data file of j from its hint file
+// when it is loaded in full, and from the data file otherwise.
+func (db *Bitcask) readLoadJob(j loadJob) loadResult {
+	df := j.df
+	var r loadResult
+	switch {
+	case j.start == df.offset:
+	case df.hr != nil && !j.tail && j.start == df.format.fileHeaderLen():
+		r.entries, r.err = db.readHintFile(df)
+	default:
+		r.entries, r.valid, r.err = db.readDataFile(df, j.start)
+	}
+	if df.hr != nil {
+		df.hr.Close()
+		df.hr = nil
+	}
+	return r
+}
@@ -0,0 +1,74 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without a checkpoint every file is read on open. A record larger
+	// than the load buffer is streamed through it.
+	opts := []Option{WithAutoMerge(false), WithCheckpointInterval(0), WithMaxFileSize(256), WithChunkSize(1 << 20)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	want := map[string]string{}
+	// The updates of a key straddle file boundaries, so its value is
+	// right only if the files are replayed in order.
+	for i := 0; i < 40; i++ {
+		k := fmt.Sprintf("key%d", i)
+		for j := 0; j < 6; j++ {
+			v := fmt.Sprintf("%d.%d", i, j)
+			if i == 20 && j == 5 {
+				v = strings.Repeat("v", 2*loadBufferSize)
+			}
+			db.Put(k, v)
+			want[k] = v
+		}
+		if i%7 == 0 {
+			db.Delete(k)
+			delete(want, k)
+		}
+	}
+	db.Close()
+	if n := len(dataFileNames(dir)); n < 20 {
+		t.Fatalf("expected many data files but got %d", n)
+	}
+
+	for _, n := range []int{0, 1, 2, 8} {
+		db, err := Open(dir, append(opts, WithLoadParallelism(n))...)
+		if err != nil {
+			t.Fatalf("%d workers: Non expected error: %s", n, err.Error())
+		}
+		checkMergeStore(t, db, want)
+		db.Close()
+	}
+
+	if _, err := Open(dir, WithLoadParallelism(-1)); err == nil {
+		t.Errorf("expected error for negative parallelism")
+	}
+
+	// A damaged file fails the open whichever worker reads it.
+	names := dataFileNames(dir)
+	data, _ := ioutil.ReadFile(names[3])
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(names[3], data, 0644)
+	os.Remove(names[3] + ".hint")
+	for _, n := range []int{1, 4} {
+		if _, err := Open(dir, append(opts, WithLoadParallelism(n))...); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%d workers: expected %v but got %v", n, ErrCorrupt, err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// manifestFile lists the live data files of the store in replay order and
+// the next file id. load trusts it instead of the directory listing.
+const manifestFile = "MANIFEST"
+
+// The manifest is laid out as file header | next id(8) | count(4) |
+// count * (id(8) | hint(1)) | version(8) | crc(4). Manifests written
+// before the version was recorded end with the files.
+const manifestEntrySize = 9
+
+// errManifestChanged is returned by the load of a read only datastore when
+// a listed file was removed because the writer switched the manifest.
+var errManifestChanged = errors.New("manifest changed while loading")
+
+// manifest is the content of the manifest file. version is the last
+// version handed out when it was written, which a merge may drop from the
+// data files with the tombstones carrying it.
+type manifest struct {
+	next    int64
+	files   []manifestEntry
+	version uint64
+}
+
+// manifestEntry records a live data file and whether it has a hint file.
+type manifestEntry struct {
+	id   int64
+	hint bool
+}
+
+func (m *manifest) encode() []byte {
+	var buf bytes.Buffer
+	buf.Write(fileHeader(0, fileManifest))
+	binary.Write(&buf, binary.BigEndian, m.next)
+	binary.Write(&buf, binary.BigEndian, uint32(len(m.files)))
+	for _, f := range m.files {
+		binary.Write(&buf, binary.BigEndian, f.id)
+		binary.Write(&buf, binary.BigEndian, f.hint)
+	}
+	binary.Write(&buf, binary.BigEndian, m.version)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < fileHeaderSize+12+4 {
+		return nil, errors.New("manifest too short")
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.New("Checksum error reading manifest")
+	}
+	if binary.BigEndian.Uint32(body[0:4]) != fileMagic ||
+		binary.BigEndian.Uint16(body[6:8]) != fileManifest {
+		return nil, errors.New("not a manifest")
+	}
+	if v := format(binary.BigEndian.Uint16(body[4:6])); v == formatV0 || v > currentFormat {
+		return nil, fmt.Errorf("%w: manifest version %d", ErrUnsupportedFormat, v)
+	}
+	body = body[fileHeaderSize:]
+	m := &manifest{next: int64(binary.BigEndian.Uint64(body[0:8]))}
+	n := int(binary.BigEndian.Uint32(body[8:12]))
+	body = body[12:]
+	switch len(body) - n*manifestEntrySize {
+	case 0:
+	case versionSize:
+		m.version = binary.BigEndian.Uint64(body[n*manifestEntrySize:])
+	default:
+		return nil, errors.New("manifest size does not match its file count")
+	}
+	for i := 0; i < n; i++ {
+		e := body[i*manifestEntrySize:]
+		m.files = append(m.files, manifestEntry{
+			id:   int64(binary.BigEndian.Uint64(e[0:8])),
+			hint: e[8] != 0,
+		})
+	}
+	return m, nil
+}
+
+// readManifest returns the manifest of the store in dir. A store written
+// before the manifest was introduced gets one built from its data files.
+func readManifest(dir string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return scanManifest(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeManifest(data)
+	if err != nil {
+		if errors.Is(err, ErrUnsupportedFormat) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, manifestFile, err)
+	}
+	return m, nil
+}
+
+// manifestChanged reports whether the manifest of dir differs from m.
+func manifestChanged(dir string, m *manifest) bool {
+	cur, err := readManifest(dir)
+	return err == nil && !bytes.Equal(cur.encode(), m.encode())
+}
+
+// scanManifest builds a manifest from the data files in dir, ordered by
+// id.
+func scanManifest(dir string) (*manifest, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{next: 1}
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) != ".data" {
+			continue
+		}
+		id, err := parseFileID(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		_, err = os.Stat(filepath.Join(dir, fi.Name()+".hint"))
+		m.files = append(m.files, manifestEntry{id: id, hint: err == nil})
+		if id >= m.next {
+			m.next = id + 1
+		}
+	}
+	sort.Slice(m.files, func(i, j int) bool { return m.files[i].id < m.files[j].id })
+	return m, nil
+}
+
+// writeManifest replaces the manifest with one listing the data files of
+// the store in replay order followed by the files with the pending ids,
+// which are about to be created. The caller must hold db.mu.
+func (db *Bitcask) writeManifest(pending ...int64) error {
+	m := &manifest{next: atomic.LoadInt64(&db.nextFileID), version: db.version}
+	for _, id := range db.order {
+		m.files = append(m.files, manifestEntry{id: id, hint: db.dataFiles[id].hint})
+	}
+	for _, id := range pending {
+		m.files = append(m.files, manifestEntry{id: id, hint: true})
+	}
+
+	return replaceFile(filepath.Join(db.directory, manifestFile), db.config.filePerm, func(w io.Writer) error {
+		_, err := w.Write(m.encode())
+		return err
+	})
+}
+
+// replaceFile atomically replaces the file name with the content written
+// by write, going through a synced temporary file.
+func replaceFile(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// removeUnlisted deletes the data and hint files the manifest does not
+// list. They are left by a merge that crashed, either the outputs of a
+// merge that had not switched to them yet or the files it replaced.
+func (db *Bitcask) removeUnlisted() error {
+	fis, err := ioutil.ReadDir(db.directory)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := strings.TrimSuffix(fi.Name(), ".hint")
+		if filepath.Ext(name) != ".data" {
+			continue
+		}
+		id, err := parseFileID(name)
+		if err != nil {
+			return err
+		}
+		if _, ok := db.dataFiles[id]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.directory, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir flushes the entries of dir to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
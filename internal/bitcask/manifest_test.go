@@ -0,0 +1,101 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	// Rotations within the same second get distinct, increasing ids.
+	for i := 0; i < 3; i++ {
+		db.Put("a", string(rune('1'+i)))
+		if err := db.rotate(); err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+	}
+	db.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	m, err := decodeManifest(data)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if len(m.files) != 4 {
+		t.Fatalf("expected %d but got %d", 4, len(m.files))
+	}
+	for i, f := range m.files {
+		if f.id != int64(i+1) || !f.hint {
+			t.Errorf("expected %v but got %v", manifestEntry{id: int64(i + 1), hint: true}, f)
+		}
+	}
+	if m.next != 5 {
+		t.Errorf("expected %d but got %d", 5, m.next)
+	}
+	if m.version != 3 {
+		t.Errorf("expected %d but got %d", 3, m.version)
+	}
+
+	// A manifest written before the version was recorded still decodes.
+	n := len(data) - versionSize - 4
+	old := make([]byte, n+4)
+	copy(old, data[:n])
+	binary.BigEndian.PutUint32(old[n:], crc32.ChecksumIEEE(old[:n]))
+	if m, err := decodeManifest(old); err != nil || len(m.files) != 4 || m.version != 0 {
+		t.Errorf("expected %d files and no version but got %+v, err %v", 4, m, err)
+	}
+
+	// A data file the manifest does not list is ignored.
+	stray, _ := ioutil.ReadFile(dataFilePath(dir, 1))
+	ioutil.WriteFile(dataFilePath(dir, 100), stray, 0644)
+
+	db, err = Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if _, got, _ := db.Get("a"); got != "3" {
+		t.Errorf("expected %v but got %v", "3", got)
+	}
+	if _, ok := db.dataFiles[100]; ok {
+		t.Errorf("expected unlisted file to be ignored")
+	}
+	// The newest file may be listed before it is created.
+	db.mu.Lock()
+	missing := db.nextFileID
+	db.nextFileID++
+	db.writeManifest(missing)
+	db.mu.Unlock()
+	db.Close()
+
+	db, err = Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if id := db.activeFile.id; id <= missing {
+		t.Errorf("expected an id after %d but got %d", missing, id)
+	}
+	db.Close()
+
+	os.Remove(dataFilePath(dir, 2))
+	if _, err := Open(dir); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected %v but got %v", ErrCorrupt, err)
+	}
+}
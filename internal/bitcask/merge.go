@@ -0,0 +1,581 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MergePolicy selects the immutable data files a merge rewrites, oldest
+// first. A file is selected when it meets every set limit. The zero value
+// selects every immutable file.
+type MergePolicy struct {
+	// DeadPercent selects only files with at least this percentage of
+	// dead bytes.
+	DeadPercent int
+	// MaxFiles limits the number of selected files.
+	MaxFiles int
+	// MaxBytes limits the live bytes the merge copies. Files that do not
+	// fit are skipped.
+	MaxBytes int64
+}
+
+// MergeStats reports the work of a merge.
+type MergeStats struct {
+	// Files holds the names of the merged data files, oldest first.
+	Files []string
+	// Reclaimed is the size of the merged data files less the size of the
+	// files that replaced them.
+	Reclaimed int64
+}
+
+// MergeOptions configures a merge run with MergeContext.
+type MergeOptions struct {
+	// Policy selects the files to merge.
+	Policy MergePolicy
+	// BytesPerSec limits the bytes the merge reads and writes per second.
+	// Zero means no limit.
+	BytesPerSec int64
+	// Progress, when set, is called each time the merge is done with a
+	// file.
+	Progress func(MergeProgress)
+}
+
+// MergeProgress reports how far a merge got.
+type MergeProgress struct {
+	// Files is the number of merged files out of TotalFiles.
+	Files      int
+	TotalFiles int
+	// BytesWritten is the size of the entries written so far.
+	BytesWritten int64
+}
+
+// errMergeCrashed is returned by a merge stopped by mergeCrash.
+var errMergeCrashed = errors.New("merge crashed")
+
+// mergeCrash is set by tests to stop a merge at the named step as if the
+// process had crashed there, leaving the files as they are.
+var mergeCrash func(step string) bool
+
+func crashed(step string) bool {
+	return mergeCrash != nil && mergeCrash(step)
+}
+
+// mergeJob is a merge in progress. The live entries of the source files
+// are copied to new output files without holding db.mu, and the store
+// switches to the outputs with a single write of the manifest. Until then
+// the outputs are not listed and Open removes them after a crash; after
+// it the sources are not listed and Open finishes removing them.
+type mergeJob struct {
+	// aead opens the entries of the sources.
+	aead    cipher.AEAD
+	sources map[int64]*dataFile
+	// order holds the ids of the sources in replay order. The outputs
+	// take the place of the last one.
+	order []int64
+	// prefix is set when the sources are the oldest files of the store,
+	// so that no older entry survives the merge and tombstones and
+	// expired entries can be dropped.
+	prefix bool
+	// live holds the keydir entries to copy, in replay order.
+	live []keyDirEntry
+	// expired holds the keydir entries the merge drops.
+	expired []keyDirEntry
+	// copies locates the copy of every live entry in the outputs.
+	copies  []keyDirEntry
+	outputs []*dataFile
+
+	// throttle paces the reads and writes of the copy.
+	throttle *throttle
+	progress func(MergeProgress)
+	written  int64
+}
+
+// Merge compacts the immutable data files, rewriting only the entries
+// that are still live. Reads and writes go on while the entries are
+// copied; they only wait for the switch to the merged files.
+func (db *Bitcask) Merge() error {
+	_, err := db.MergeWith(MergePolicy{})
+	return err
+}
+
+// MergeWith compacts the immutable data files selected by p.
+func (db *Bitcask) MergeWith(p MergePolicy) (MergeStats, error) {
+	return db.MergeContext(context.Background(), MergeOptions{Policy: p})
+}
+
+// MergeContext compacts the immutable data files as configured by opts.
+// When ctx is done before the merge switches to the merged files, the
+// merge stops, removes them and returns the error of ctx; the store is
+// left as it was. Close stops the merge the same way.
+func (db *Bitcask) MergeContext(ctx context.Context, opts MergeOptions) (MergeStats, error) {
+	if db.readOnly {
+		return MergeStats{}, ErrReadOnly
+	}
+	if err := db.lockMerge(); err != nil {
+		return MergeStats{}, err
+	}
+	defer db.unlockMerge()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-db.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return db.merge(ctx, opts)
+}
+
+// lockMerge waits for a merge of this process to finish and fails if
+// another process is merging or the store is closed.
+func (db *Bitcask) lockMerge() error {
+	// The file lock does not exclude a second merge of the same process.
+	db.mergeMu.Lock()
+	select {
+	case <-db.done:
+		db.mergeMu.Unlock()
+		return errors.New("Database is closed")
+	default:
+	}
+	locked, err := db.mergeLock.TryLock()
+	if err == nil && !locked {
+		err = errors.New("Database is locked for merging")
+	}
+	if err != nil {
+		db.mergeMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (db *Bitcask) unlockMerge() {
+	db.mergeLock.Unlock()
+	db.mergeMu.Unlock()
+}
+
+// merge runs a merge configured by opts that keeps the encryption key of
+// the store. The caller must hold the merge lock.
+func (db *Bitcask) merge(ctx context.Context, opts MergeOptions) (MergeStats, error) {
+	db.mu.Lock()
+	job := db.planMerge(opts.Policy)
+	db.mu.Unlock()
+	if len(job.sources) == 0 {
+		return MergeStats{}, nil
+	}
+	job.throttle = newThrottle(opts.BytesPerSec)
+	job.progress = opts.Progress
+	if err := db.copyMerge(ctx, job, job.aead); err != nil {
+		return MergeStats{}, db.abortMerge(job, err)
+	}
+	db.mu.Lock()
+	err := ctx.Err()
+	if err == nil {
+		err = db.swapMerge(job)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return MergeStats{}, db.abortMerge(job, err)
+	}
+	return job.stats(), db.removeMerged(job)
+}
+
+// selects returns true if p selects df after n files with the given live
+// bytes were selected.
+func (p MergePolicy) selects(df *dataFile, n int, bytes int64) bool {
+	if df.stat.fragmented < p.DeadPercent {
+		return false
+	}
+	if p.MaxFiles > 0 && n >= p.MaxFiles {
+		return false
+	}
+	return p.MaxBytes <= 0 || bytes+liveBytes(df) <= p.MaxBytes
+}
+
+// liveBytes returns the size of the live entries of df.
+func liveBytes(df *dataFile) int64 {
+	return int64(df.stat.totalbytes-df.stat.deadbytes) - df.format.fileHeaderLen()
+}
+
+// planMerge takes the immutable data files selected by p as the sources
+// of a merge and collects their live entries. The caller must hold db.mu.
+func (db *Bitcask) planMerge(p MergePolicy) *mergeJob {
+	job := &mergeJob{
+		aead:    db.aead,
+		sources: make(map[int64]*dataFile, len(db.order)),
+		prefix:  true,
+	}
+	rank := make(map[int64]int, len(db.order))
+	var bytes int64
+	skipped := false
+	for i, id := range db.order {
+		df := db.dataFiles[id]
+		if id == db.activeFile.id || !p.selects(df, len(job.order), bytes) {
+			skipped = true
+			continue
+		}
+		job.prefix = job.prefix && !skipped
+		job.sources[id] = df
+		job.order = append(job.order, id)
+		rank[id] = i
+		bytes += liveBytes(df)
+	}
+	now := unixNow()
+	db.keyDir.each(func(kd keyDirEntry) bool {
+		if _, ok := job.sources[kd.fileID]; !ok {
+			return true
+		}
+		if kd.expired(now) && job.prefix {
+			job.expired = append(job.expired, kd)
+		} else {
+			job.live = append(job.live, kd)
+		}
+		return true
+	})
+	live := job.live
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].fileID != live[j].fileID {
+			return rank[live[i].fileID] < rank[live[j].fileID]
+		}
+		return live[i].valuePos < live[j].valuePos
+	})
+	return job
+}
+
+// copyMerge writes the live entries of job to new data files, sealing
+// them with aead, and syncs them. It only reads the sources, so db.mu
+// need not be held when the sources are the oldest files; otherwise it
+// takes db.mu to check which tombstones must be kept. It stops with the
+// error of ctx when ctx is done.
+func (db *Bitcask) copyMerge(ctx context.Context, job *mergeJob, aead cipher.AEAD) error {
+	var out *dataFile
+	next := func() error {
+		if out != nil && out.offset < db.config.maxFileSize {
+			return nil
+		}
+		var err error
+		out, err = createDataFile(db.directory, db.allocFileID(), db.config.filePerm)
+		if err != nil {
+			return err
+		}
+		job.outputs = append(job.outputs, out)
+		return nil
+	}
+	if !job.prefix {
+		tombstones, err := db.mergeTombstones(ctx, job)
+		if err != nil {
+			return err
+		}
+		for _, t := range tombstones {
+			if err := next(); err != nil {
+				return err
+			}
+			n, err := writeTombstone(out, t, aead)
+			if err != nil {
+				return err
+			}
+			job.written += n
+			if err := job.throttle.wait(ctx, n); err != nil {
+				return err
+			}
+		}
+	}
+	index := make(map[int64]int, len(job.order))
+	for i, id := range job.order {
+		index[id] = i
+	}
+	job.copies = make([]keyDirEntry, len(job.live))
+	for i, kd := range job.live {
+		if i > 0 && kd.fileID != job.live[i-1].fileID {
+			job.report(index[kd.fileID])
+		}
+		if err := next(); err != nil {
+			return err
+		}
+		cp := kd
+		buf, err := db.mergeRecord(job.sources[kd.fileID], &cp, job.aead, aead, out.id, out.offset)
+		if err != nil {
+			return err
+		}
+		if err := job.throttle.wait(ctx, kd.recordSize()+int64(len(buf))); err != nil {
+			return err
+		}
+		if _, err := out.w.Write(buf); err != nil {
+			return err
+		}
+		job.written += int64(len(buf))
+		out.offset += int64(len(buf))
+		out.stat.written(len(buf), cp.timestamp)
+		var hint bytes.Buffer
+		if _, err := encodeKeyEntry(&hint, &cp, aead); err != nil {
+			return err
+		}
+		if _, err := out.hw.Write(hint.Bytes()); err != nil {
+			return err
+		}
+		job.copies[i] = cp
+	}
+	job.report(len(job.order))
+	if crashed("copy") {
+		return errMergeCrashed
+	}
+	for _, out := range job.outputs {
+		if err := out.w.Sync(); err != nil {
+			return err
+		}
+		if err := out.hw.Sync(); err != nil {
+			return err
+		}
+		out.w.Close()
+		out.hw.Close()
+		out.hr.Close()
+		out.w, out.hw, out.hr = nil, nil, nil
+		db.mapDataFile(out)
+	}
+	if err := syncDir(db.directory); err != nil {
+		return err
+	}
+	if crashed("sync") {
+		return errMergeCrashed
+	}
+	return nil
+}
+
+// mergeTombstones returns the newest tombstone in the sources of job of
+// every key that is still deleted. Unless the sources are the oldest
+// files they hide older entries that the merge does not drop. A key that
+// was written again needs no tombstone, and must not get one as its live
+// entry may be older than the outputs.
+func (db *Bitcask) mergeTombstones(ctx context.Context, job *mergeJob) ([]*entry, error) {
+	latest := make(map[string]*keyDirEntry)
+	var keys []string
+	for _, id := range job.order {
+		it, err := newDataFileIter(job.sources[id], job.aead)
+		if err != nil {
+			return nil, err
+		}
+		for it.HasNext() {
+			pos := it.curr
+			kd, _, err := it.Next()
+			if err == nil {
+				err = job.throttle.wait(ctx, it.curr-pos)
+			}
+			if err != nil {
+				it.Close()
+				return nil, err
+			}
+			if !kd.tombstone() || kd.flags&flagCommit != 0 {
+				continue
+			}
+			if _, ok := latest[string(kd.key)]; !ok {
+				keys = append(keys, string(kd.key))
+			}
+			latest[string(kd.key)] = kd
+		}
+		it.Close()
+	}
+	var es []*entry
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, k := range keys {
+		if _, ok := db.keyDir.get(k); ok {
+			continue
+		}
+		kd := latest[k]
+		es = append(es, &entry{
+			timestamp: kd.timestamp,
+			ksz:       uint32(len(kd.key)),
+			flags:     kd.flags & flagVersion,
+			version:   kd.version,
+			key:       kd.key,
+			value:     []byte{},
+		})
+	}
+	return es, nil
+}
+
+// writeTombstone appends the tombstone e to out, with its hint, and
+// returns its size. Like any tombstone it only takes up dead bytes.
+func writeTombstone(out *dataFile, e *entry, aead cipher.AEAD) (int64, error) {
+	var buf bytes.Buffer
+	if _, err := encode(&buf, e, currentFormat, aead); err != nil {
+		return 0, err
+	}
+	kd := locate(out.id, out.offset, []*entry{e})
+	if _, err := out.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	out.offset += int64(buf.Len())
+	out.stat.written(buf.Len(), kd.timestamp)
+	out.stat.deadbytes += buf.Len()
+	var hint bytes.Buffer
+	if _, err := encodeKeyEntry(&hint, &kd, aead); err != nil {
+		return 0, err
+	}
+	_, err := out.hw.Write(hint.Bytes())
+	return int64(buf.Len()), err
+}
+
+// swapMerge replaces the sources of job with its outputs, first in the
+// manifest and then in the keydir. Entries written while the merge copied
+// them keep their newer location. The caller must hold db.mu.
+func (db *Bitcask) swapMerge(job *mergeJob) error {
+	last := job.order[len(job.order)-1]
+	order := make([]int64, 0, len(job.outputs)+len(db.order))
+	for _, id := range db.order {
+		if id == last {
+			for _, out := range job.outputs {
+				order = append(order, out.id)
+			}
+		}
+		if _, ok := job.sources[id]; !ok {
+			order = append(order, id)
+		}
+	}
+	outputs := make(map[int64]*dataFile, len(job.outputs))
+	for _, out := range job.outputs {
+		outputs[out.id] = out
+		db.dataFiles[out.id] = out
+	}
+	prev := db.order
+	db.order = order
+	if err := db.writeManifest(); err != nil {
+		db.order = prev
+		for id := range outputs {
+			delete(db.dataFiles, id)
+		}
+		return err
+	}
+	if crashed("manifest") {
+		return errMergeCrashed
+	}
+	for i, kd := range job.live {
+		k := string(kd.key)
+		if cur, ok := db.keyDir.get(k); ok && cur.sameRecord(&kd) {
+			db.keyDir.put(job.copies[i])
+			db.cache.invalidate(k)
+			continue
+		}
+		out := outputs[job.copies[i].fileID]
+		out.stat.deadbytes += int(job.copies[i].recordSize())
+	}
+	for _, kd := range job.expired {
+		if cur, ok := db.keyDir.get(string(kd.key)); ok && cur.sameRecord(&kd) {
+			db.removeKey(string(kd.key))
+		}
+	}
+	for id, df := range job.sources {
+		df.close()
+		delete(db.dataFiles, id)
+	}
+	for _, out := range job.outputs {
+		out.stat.update()
+	}
+	return nil
+}
+
+// report passes the progress of the copy to the callback of job once the
+// first files of its sources are done.
+func (job *mergeJob) report(files int) {
+	if job.progress == nil {
+		return
+	}
+	job.progress(MergeProgress{
+		Files:        files,
+		TotalFiles:   len(job.order),
+		BytesWritten: job.written,
+	})
+}
+
+// stats returns the report of a merge that switched to its outputs.
+func (job *mergeJob) stats() MergeStats {
+	var s MergeStats
+	for _, id := range job.order {
+		df := job.sources[id]
+		s.Files = append(s.Files, filepath.Base(df.name))
+		s.Reclaimed += df.offset
+	}
+	for _, out := range job.outputs {
+		s.Reclaimed -= out.offset
+	}
+	return s
+}
+
+// abortMerge removes the outputs of a merge that failed before the switch
+// and returns err. A crashed merge leaves them for Open to remove.
+func (db *Bitcask) abortMerge(job *mergeJob, err error) error {
+	if err == errMergeCrashed {
+		return err
+	}
+	for _, out := range job.outputs {
+		if out.w != nil {
+			out.w.Close()
+			out.hw.Close()
+			out.hr.Close()
+		}
+		out.close()
+		os.Remove(out.name)
+		os.Remove(out.name + ".hint")
+	}
+	return err
+}
+
+// removeMerged deletes the sources of a merge that switched to its
+// outputs.
+func (db *Bitcask) removeMerged(job *mergeJob) error {
+	for _, df := range job.sources {
+		if err := os.Remove(df.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if crashed("remove") {
+			return errMergeCrashed
+		}
+		if err := os.Remove(df.name + ".hint"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeRecord returns the entries backing kd in src as a merge writes
+// them, in the current format, sealed with to instead of from and without
+// the batch flag, and updates kd to locate them at offset pos of file id.
+// Values that are not compressed yet are compressed when the
+// configuration asks for it.
+func (db *Bitcask) mergeRecord(src *dataFile, kd *keyDirEntry, from, to cipher.AEAD, id, pos int64) ([]byte, error) {
+	buf := make([]byte, kd.recordSize())
+	if err := src.readAt(buf, kd.recordPos()); err != nil {
+		return nil, err
+	}
+	es, err := decodeAll(buf, kd.format, from)
+	if err != nil {
+		return nil, err
+	}
+	if kd.flags&flagCompressed == 0 && db.shouldCompress(int(kd.valueSz)) {
+		var value []byte
+		for _, e := range es {
+			value = append(value, e.value...)
+		}
+		var expiry uint32
+		if kd.flags&flagExpiry != 0 {
+			expiry = kd.expiry
+		}
+		if c := db.split(kd.key, value, kd.timestamp, expiry, kd.version); c[0].flags&flagCompressed != 0 {
+			es = c
+		}
+	}
+	var out bytes.Buffer
+	for _, e := range es {
+		e.flags &^= flagBatch
+		if _, err := encode(&out, e, currentFormat, to); err != nil {
+			return nil, err
+		}
+	}
+	*kd = locate(id, pos, es)
+	return out.Bytes(), nil
+}
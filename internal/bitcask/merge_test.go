@@ -0,0 +1,411 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fillMergeStore writes overwritten and deleted keys over several data
+// files and returns the expected content of the store.
+func fillMergeStore(db *Bitcask) map[string]string {
+	want := map[string]string{}
+	for i := 0; i < 40; i++ {
+		k := fmt.Sprintf("key%d", i%10)
+		v := strings.Repeat(fmt.Sprintf("%d", i), i%7+1)
+		db.Put(k, v)
+		want[k] = v
+	}
+	db.Delete("key3")
+	delete(want, "key3")
+	return want
+}
+
+func checkMergeStore(t *testing.T, db *Bitcask, want map[string]string) {
+	t.Helper()
+	for k, v := range want {
+		if _, got, err := db.Get(k); err != nil || got != v {
+			t.Errorf("%s: expected %v but got %v, err %v", k, v, got, err)
+		}
+	}
+	if n := db.Size(); n != len(want) {
+		t.Errorf("expected %d keys but got %d", len(want), n)
+	}
+}
+
+// listedFiles returns the data and hint files the manifest of dir lists
+// and the ones found in dir.
+func listedFiles(t *testing.T, dir string) ([]string, []string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	m, err := decodeManifest(data)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	var listed []string
+	for _, f := range m.files {
+		name := dataFilePath(dir, f.id)
+		listed = append(listed, name, name+".hint")
+	}
+	found, _ := filepath.Glob(filepath.Join(dir, "*.bitcask.data*"))
+	sort.Strings(listed)
+	sort.Strings(found)
+	return listed, found
+}
+
+// crash drops db as a crash of its process would: its goroutines stop and
+// its files are closed without syncing them, writing the hint of the
+// active file or a keydir checkpoint.
+func crash(db *Bitcask) {
+	db.closeOnce.Do(func() {
+		close(db.done)
+		db.wg.Wait()
+		if !db.readOnly {
+			db.activeFile.w.Close()
+			db.activeFile.hw.Close()
+			db.activeFile.hr.Close()
+		}
+		for _, df := range db.dataFiles {
+			df.close()
+		}
+		db.fileLock.Unlock()
+	})
+}
+
+func TestMergeCrash(t *testing.T) {
+	defer func() { mergeCrash = nil }()
+	for _, step := range []string{"copy", "sync", "manifest", "remove"} {
+		t.Run(step, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opts := []Option{WithAutoMerge(false), WithMaxFileSize(128)}
+			db, err := Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			want := fillMergeStore(db)
+
+			mergeCrash = func(s string) bool { return s == step }
+			if err := db.Merge(); err != errMergeCrashed {
+				t.Fatalf("expected %v but got %v", errMergeCrashed, err)
+			}
+			mergeCrash = nil
+			crash(db)
+			// Open replays the data files listed in the manifest.
+			if _, err := os.Stat(filepath.Join(dir, checkpointFile)); !os.IsNotExist(err) {
+				t.Fatalf("expected no keydir checkpoint but got %v", err)
+			}
+
+			db, err = Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			checkMergeStore(t, db, want)
+			if listed, found := listedFiles(t, dir); strings.Join(listed, " ") != strings.Join(found, " ") {
+				t.Errorf("expected %v but got %v", listed, found)
+			}
+			if err := db.Merge(); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			db.Close()
+
+			db, err = Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			checkMergeStore(t, db, want)
+		})
+	}
+}
+
+func TestMergeConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithAutoMerge(false), WithMaxFileSize(128)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	want := fillMergeStore(db)
+
+	copied, release := make(chan struct{}), make(chan struct{})
+	mergeCrash = func(step string) bool {
+		if step == "copy" {
+			close(copied)
+			<-release
+		}
+		return false
+	}
+	defer func() { mergeCrash = nil }()
+	done := make(chan error)
+	go func() { done <- db.Merge() }()
+
+	<-copied
+	// Reads and writes are served while the merge copies the entries.
+	writes := make(chan struct{})
+	go func() {
+		db.Put("key1", "new")
+		db.Delete("key2")
+		db.Get("key4")
+		close(writes)
+	}()
+	select {
+	case <-writes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("writes blocked by the merge")
+	}
+	want["key1"] = "new"
+	delete(want, "key2")
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	checkMergeStore(t, db, want)
+	db.Close()
+
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	checkMergeStore(t, db, want)
+}
+
+// openMergeStore opens a store in a new directory and writes the files
+// of puts, one data file each. A value of "" deletes the key.
+func openMergeStore(t *testing.T, files ...[][2]string) (*Bitcask, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	for _, puts := range files {
+		for _, p := range puts {
+			if p[1] == "" {
+				db.Delete(p[0])
+			} else {
+				db.Put(p[0], p[1])
+			}
+		}
+		if err := db.rotate(); err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+	}
+	return db, dir
+}
+
+func TestMergePolicy(t *testing.T) {
+	// 28%, 44% and 0% dead, counting the file headers, with 60, 60 and 30
+	// live bytes.
+	files := [][][2]string{
+		{{"a", "1"}, {"b", "1"}, {"a", "2"}},
+		{{"c", "1"}, {"c", "2"}, {"c", "3"}, {"d", "1"}},
+		{{"e", "1"}},
+	}
+	want := map[string]string{"a": "2", "b": "1", "c": "3", "d": "1", "e": "1"}
+	tests := []struct {
+		name   string
+		policy MergePolicy
+		merged []int64
+	}{
+		{"all", MergePolicy{}, []int64{1, 2, 3}},
+		{"max files", MergePolicy{MaxFiles: 2}, []int64{1, 2}},
+		{"dead percent", MergePolicy{DeadPercent: 40}, []int64{2}},
+		{"max bytes", MergePolicy{MaxBytes: 90}, []int64{1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, dir := openMergeStore(t, files...)
+			defer os.RemoveAll(dir)
+
+			stats, err := db.MergeWith(tt.policy)
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			var names []string
+			for _, id := range tt.merged {
+				names = append(names, filepath.Base(dataFilePath(dir, id)))
+			}
+			if strings.Join(stats.Files, " ") != strings.Join(names, " ") {
+				t.Errorf("expected %v but got %v", names, stats.Files)
+			}
+			if stats.Reclaimed <= 0 {
+				t.Errorf("expected reclaimed bytes but got %d", stats.Reclaimed)
+			}
+			checkMergeStore(t, db, want)
+			db.Close()
+
+			db, err = Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			checkMergeStore(t, db, want)
+		})
+	}
+}
+
+func TestMergePolicyTombstones(t *testing.T) {
+	var live [][2]string
+	for i := 0; i < 9; i++ {
+		live = append(live, [2]string{fmt.Sprintf("p%d", i), "1"})
+	}
+	tests := []struct {
+		name  string
+		files [][][2]string
+		// skipped is the file the merge leaves.
+		skipped int64
+		want    map[string]string
+	}{
+		// The tombstone of k in the merged file hides its value in the
+		// older file, which is not merged.
+		{"kept", [][][2]string{
+			append([][2]string{{"k", "1"}}, live...),
+			{{"k", ""}, {"x", "1"}, {"x", "2"}},
+		}, 1, map[string]string{"x": "2"}},
+		// The tombstone of k in the first merged file must not hide its
+		// newer value in the file between the merged files.
+		{"dropped", [][][2]string{
+			{{"k", "1"}, {"k", ""}, {"y", "1"}, {"y", "2"}},
+			append([][2]string{{"k", "2"}}, live...),
+			{{"z", "1"}, {"z", "2"}, {"z", "3"}},
+		}, 2, map[string]string{"k": "2", "y": "2", "z": "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, dir := openMergeStore(t, tt.files...)
+			defer os.RemoveAll(dir)
+			for _, kv := range live {
+				tt.want[kv[0]] = kv[1]
+			}
+
+			if _, err := db.MergeWith(MergePolicy{DeadPercent: 50}); err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			if _, ok := db.dataFiles[tt.skipped]; !ok {
+				t.Fatalf("expected file %d not to be merged", tt.skipped)
+			}
+			checkMergeStore(t, db, tt.want)
+			db.Close()
+
+			db, err := Open(dir, WithAutoMerge(false))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			checkMergeStore(t, db, tt.want)
+		})
+	}
+}
+
+func TestMergeContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithAutoMerge(false), WithMaxFileSize(128)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	want := fillMergeStore(db)
+
+	// A merge cancelled while it copies leaves the store as it was.
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = db.MergeContext(ctx, MergeOptions{
+		Progress: func(MergeProgress) { cancel() },
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected %v but got %v", context.Canceled, err)
+	}
+	checkMergeStore(t, db, want)
+	if listed, found := listedFiles(t, dir); strings.Join(listed, " ") != strings.Join(found, " ") {
+		t.Errorf("expected %v but got %v", listed, found)
+	}
+
+	var progress []MergeProgress
+	stats, err := db.MergeContext(context.Background(), MergeOptions{
+		Progress: func(p MergeProgress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if len(progress) == 0 {
+		t.Fatalf("expected progress to be reported")
+	}
+	for i, p := range progress {
+		if p.TotalFiles != len(stats.Files) {
+			t.Errorf("expected %d but got %d", len(stats.Files), p.TotalFiles)
+		}
+		if i > 0 && (p.Files <= progress[i-1].Files || p.BytesWritten < progress[i-1].BytesWritten) {
+			t.Errorf("expected progress after %+v but got %+v", progress[i-1], p)
+		}
+	}
+	if last := progress[len(progress)-1]; last.Files != last.TotalFiles || last.BytesWritten == 0 {
+		t.Errorf("expected all files merged but got %+v", last)
+	}
+	db.Close()
+
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	checkMergeStore(t, db, want)
+}
+
+func TestMergeThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithAutoMerge(false), WithMaxFileSize(128))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	want := fillMergeStore(db)
+
+	const rate = 10000
+	var written int64
+	start := time.Now()
+	_, err = db.MergeContext(context.Background(), MergeOptions{
+		BytesPerSec: rate,
+		Progress:    func(p MergeProgress) { written = p.BytesWritten },
+	})
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	// The merge reads at least as many bytes as it writes.
+	if min, got := time.Duration(2*written*int64(time.Second)/rate), time.Since(start); got < min {
+		t.Errorf("expected at least %s but took %s", min, got)
+	}
+	checkMergeStore(t, db, want)
+}
@@ -0,0 +1,47 @@
+package bitcask
+
+import "io"
+
+// mapDataFile memory-maps the immutable data file df when the store was
+// opened WithMmap. A file that cannot be mapped keeps being read with
+// ReadAt.
+func (db *Bitcask) mapDataFile(df *dataFile) {
+	if !db.config.mmap || df.data != nil || df.offset == 0 {
+		return
+	}
+	if data, err := mmap(df.r, df.offset); err == nil {
+		df.data = data
+	}
+}
+
+// mapped returns the n bytes at off of the mapping of df without copying
+// them. The slice is only valid until df is closed.
+func (df *dataFile) mapped(off, n int64) ([]byte, bool) {
+	if df.data == nil || off < 0 || off+n > int64(len(df.data)) {
+		return nil, false
+	}
+	return df.data[off : off+n : off+n], true
+}
+
+// readAt fills buf with the bytes at off of df, from its mapping when it
+// has one.
+func (df *dataFile) readAt(buf []byte, off int64) error {
+	if b, ok := df.mapped(off, int64(len(buf))); ok {
+		copy(buf, b)
+		return nil
+	}
+	if df.data != nil {
+		return io.ErrUnexpectedEOF
+	}
+	_, err := df.r.ReadAt(buf, off)
+	return err
+}
+
+// close unmaps df and closes its reader.
+func (df *dataFile) close() error {
+	if df.data != nil {
+		munmap(df.data)
+		df.data = nil
+	}
+	return df.r.Close()
+}
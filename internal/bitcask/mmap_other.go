@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package bitcask
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap is not supported on this platform, so data files are read with
+// ReadAt.
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,103 @@
+package bitcask
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte("0123456789abcdef")
+	opts := []Option{WithAutoMerge(false), WithMaxFileSize(512), WithChunkSize(64), WithMmap(true)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	want := map[string]string{}
+	for i := 0; i < 40; i++ {
+		k := fmt.Sprintf("key%d", i%10)
+		v := strings.Repeat(fmt.Sprintf("%d", i), i%5*40+1)
+		db.Put(k, v)
+		want[k] = v
+	}
+	checkMapped := func(db *Bitcask) {
+		t.Helper()
+		for id, df := range db.dataFiles {
+			if mapped := df.data != nil; mapped == (df == db.activeFile) {
+				t.Errorf("file %d: expected mapped %t but got %t", id, !mapped, mapped)
+			}
+		}
+	}
+	checkMapped(db)
+	checkMergeStore(t, db, want)
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	checkMapped(db)
+	checkMergeStore(t, db, want)
+	db.Close()
+
+	// Encrypted and chunked records are decoded from the mapping.
+	if err := func() error {
+		db, err := Open(dir, opts...)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.RotateKey(key)
+	}(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db, err = Open(dir, append(opts, WithEncryptionKey(key))...)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	checkMapped(db)
+	checkMergeStore(t, db, want)
+}
+
+func TestReadCompressed(t *testing.T) {
+	verbose := strings.Repeat(`{"name":"value","list":[1,2,3]}`, 50)
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap %t", mmap), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// With the default chunk size the value is a single record.
+			db, err := Open(dir, WithAutoMerge(false), WithCompression(true), WithMmap(mmap))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			db.Put("k", verbose)
+			if kd, _ := db.keyDir.get("k"); kd.flags&(flagCompressed|flagChunk) != flagCompressed {
+				t.Fatalf("expected an unchunked compressed record but got flags %b", kd.flags)
+			}
+			check := func(step string) {
+				t.Helper()
+				if _, got, err := db.Get("k"); err != nil || got != verbose {
+					t.Errorf("%s: expected %d bytes but got %d (%v)", step, len(verbose), len(got), err)
+				}
+			}
+			check("active file")
+			db.mu.Lock()
+			db.rotate()
+			db.mu.Unlock()
+			check("immutable file")
+		})
+	}
+}
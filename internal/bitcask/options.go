@@ -0,0 +1,274 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Option configures a Bitcask datastore opened with Open.
+type Option func(*config)
+
+type config struct {
+	maxFileSize          int64
+	maxKeySize           uint32
+	maxValueSize         uint32
+	chunkSize            uint32
+	filePerm             os.FileMode
+	dirPerm              os.FileMode
+	fragmentation        int
+	deadBytesThreshold   int64
+	sweepInterval        time.Duration
+	autoMerge            bool
+	mergeInterval        time.Duration
+	mergePolicy          MergePolicy
+	mergeRate            int64
+	recovery             bool
+	sync                 SyncPolicy
+	compression          bool
+	compressionThreshold uint32
+	encryptionKey        []byte
+	mmap                 bool
+	cacheSize            int64
+	checkpointInterval   time.Duration
+	loadParallelism      int
+}
+
+func defaultConfig() *config {
+	return &config{
+		maxFileSize:          threshold,
+		maxKeySize:           maxKsz,
+		maxValueSize:         maxVsz,
+		chunkSize:            chunkSize,
+		filePerm:             0755,
+		dirPerm:              0755,
+		fragmentation:        fragmentation,
+		deadBytesThreshold:   deadBytesThreshold,
+		sweepInterval:        sweepInterval,
+		autoMerge:            true,
+		mergeInterval:        mergeInterval,
+		compressionThreshold: compressionThreshold,
+		checkpointInterval:   checkpointInterval,
+	}
+}
+
+func (c *config) validate() error {
+	switch {
+	case c.maxFileSize <= 0:
+		return errors.New("max file size must be positive")
+	case c.maxKeySize == 0 || c.maxKeySize > kszMask:
+		return fmt.Errorf("max key size must be between 1 and %d", kszMask)
+	case c.maxValueSize == 0:
+		return errors.New("max value size must be positive")
+	case c.chunkSize == 0:
+		return errors.New("chunk size must be positive")
+	case c.filePerm&0600 != 0600:
+		return fmt.Errorf("file permissions %v must allow owner read and write", c.filePerm)
+	case c.dirPerm&0700 != 0700:
+		return fmt.Errorf("directory permissions %v must allow owner access", c.dirPerm)
+	case c.fragmentation < 0 || c.fragmentation > 100:
+		return fmt.Errorf("fragmentation %d must be a percentage", c.fragmentation)
+	case c.deadBytesThreshold < 0:
+		return errors.New("dead bytes threshold must not be negative")
+	case c.sweepInterval < 0:
+		return errors.New("sweep interval must not be negative")
+	case c.mergeInterval < 0:
+		return errors.New("merge interval must not be negative")
+	case c.mergePolicy.DeadPercent < 0 || c.mergePolicy.DeadPercent > 100:
+		return fmt.Errorf("merge dead percent %d must be a percentage", c.mergePolicy.DeadPercent)
+	case c.mergePolicy.MaxFiles < 0 || c.mergePolicy.MaxBytes < 0:
+		return errors.New("merge limits must not be negative")
+	case c.mergeRate < 0:
+		return errors.New("merge rate must not be negative")
+	case c.cacheSize < 0:
+		return errors.New("cache size must not be negative")
+	case c.checkpointInterval < 0:
+		return errors.New("checkpoint interval must not be negative")
+	case c.loadParallelism < 0:
+		return errors.New("load parallelism must not be negative")
+	case c.sync.interval < 0:
+		return errors.New("sync interval must not be negative")
+	case c.encryptionKey != nil && len(c.encryptionKey) != 16 && len(c.encryptionKey) != 24 && len(c.encryptionKey) != 32:
+		return fmt.Errorf("encryption key of %d bytes must be 16, 24 or 32 bytes long", len(c.encryptionKey))
+	}
+	return nil
+}
+
+// WithMaxFileSize sets the size in bytes after which the active data file
+// is rotated.
+func WithMaxFileSize(size int64) Option {
+	return func(c *config) {
+		c.maxFileSize = size
+	}
+}
+
+// WithMaxKeySize sets the maximum key size in bytes.
+func WithMaxKeySize(size uint32) Option {
+	return func(c *config) {
+		c.maxKeySize = size
+	}
+}
+
+// WithMaxValueSize sets the maximum value size in bytes.
+func WithMaxValueSize(size uint32) Option {
+	return func(c *config) {
+		c.maxValueSize = size
+	}
+}
+
+// WithChunkSize sets the size in bytes above which values are split into
+// chained chunk entries.
+func WithChunkSize(size uint32) Option {
+	return func(c *config) {
+		c.chunkSize = size
+	}
+}
+
+// WithFilePerm sets the permissions of newly created data and hint files.
+func WithFilePerm(perm os.FileMode) Option {
+	return func(c *config) {
+		c.filePerm = perm
+	}
+}
+
+// WithDirPerm sets the permissions used when creating the database directory.
+func WithDirPerm(perm os.FileMode) Option {
+	return func(c *config) {
+		c.dirPerm = perm
+	}
+}
+
+// WithFragmentation sets the percentage of dead bytes in a data file
+// that makes it a merge candidate. Zero disables this trigger.
+func WithFragmentation(percent int) Option {
+	return func(c *config) {
+		c.fragmentation = percent
+	}
+}
+
+// WithDeadBytesThreshold sets the amount of dead bytes in a data file
+// that makes it a merge candidate. Zero disables this trigger.
+func WithDeadBytesThreshold(size int64) Option {
+	return func(c *config) {
+		c.deadBytesThreshold = size
+	}
+}
+
+// WithSweepInterval sets how often expired keys are replaced by tombstones.
+// A zero interval disables the background sweeper.
+func WithSweepInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.sweepInterval = d
+	}
+}
+
+// WithAutoMerge enables or disables merging in the background when a data
+// file crosses the fragmentation or dead bytes threshold.
+func WithAutoMerge(enabled bool) Option {
+	return func(c *config) {
+		c.autoMerge = enabled
+	}
+}
+
+// WithMergeInterval sets the minimum time between two background merges.
+func WithMergeInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.mergeInterval = d
+	}
+}
+
+// WithMergePolicy sets the files a background merge rewrites. The default
+// policy rewrites every immutable file.
+func WithMergePolicy(p MergePolicy) Option {
+	return func(c *config) {
+		c.mergePolicy = p
+	}
+}
+
+// WithMergeRate limits the bytes a background merge reads and writes per
+// second. Zero means no limit.
+func WithMergeRate(bytesPerSec int64) Option {
+	return func(c *config) {
+		c.mergeRate = bytesPerSec
+	}
+}
+
+// WithRecovery makes Open validate every record of the data files instead
+// of trusting the hint files. The newest data file is truncated after its
+// last valid record and older corrupt files are moved to the quarantine
+// directory. Bitcask.Recovery reports what was dropped.
+func WithRecovery(enabled bool) Option {
+	return func(c *config) {
+		c.recovery = enabled
+	}
+}
+
+// WithSync sets when writes are flushed to stable storage. The default is
+// SyncNever.
+func WithSync(p SyncPolicy) Option {
+	return func(c *config) {
+		c.sync = p
+	}
+}
+
+// WithCompression enables or disables deflating values when they are
+// written. Stores keep reading entries written with either setting.
+func WithCompression(enabled bool) Option {
+	return func(c *config) {
+		c.compression = enabled
+	}
+}
+
+// WithCompressionThreshold sets the size in bytes below which values are
+// written uncompressed.
+func WithCompressionThreshold(size uint32) Option {
+	return func(c *config) {
+		c.compressionThreshold = size
+	}
+}
+
+// WithEncryptionKey encrypts the keys and values of new entries with
+// AES-GCM using key, which must be 16, 24 or 32 bytes long. An encrypted
+// store can only be opened with its key; RotateKey replaces it.
+func WithEncryptionKey(key []byte) Option {
+	return func(c *config) {
+		c.encryptionKey = key
+	}
+}
+
+// WithMmap serves reads of the immutable data files from memory mappings
+// instead of one system call per read. The active data file is always
+// read with ReadAt. Values are copied out of the mappings rather than
+// returned as slices of them: the caller owns the slice GetBytes returns,
+// while Merge and Close unmap the files it would point into.
+func WithMmap(enabled bool) Option {
+	return func(c *config) {
+		c.mmap = enabled
+	}
+}
+
+// WithValueCache keeps the most recently read values in memory, up to
+// size bytes of keys and values. Zero disables the cache.
+func WithValueCache(size int64) Option {
+	return func(c *config) {
+		c.cacheSize = size
+	}
+}
+
+// WithCheckpointInterval sets how often the keydir is saved to a
+// checkpoint, which Open loads instead of replaying the data files it
+// covers. The keydir is also saved by Close. Zero disables saving.
+func WithCheckpointInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.checkpointInterval = d
+	}
+}
+
+// WithLoadParallelism sets how many data and hint files Open reads at
+// once. Zero reads as many as GOMAXPROCS allows.
+func WithLoadParallelism(n int) Option {
+	return func(c *config) {
+		c.loadParallelism = n
+	}
+}
@@ -0,0 +1,91 @@
+package bitcask
+
+import "errors"
+
+// OpenReadOnly opens an existing Bitcask datastore without taking the
+// write lock, so it can be used next to a process that has it open with
+// Open. Writes return ErrReadOnly. The keydir reflects the files at the
+// time of the call; Refresh picks up later writes and rotated files.
+func OpenReadOnly(path string, opts ...Option) (*Bitcask, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.recovery {
+		return nil, errors.New("recovery requires a writable datastore")
+	}
+
+	db, err := newBitcask(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+	if _, err := checkKey(path, db.aead, cfg.filePerm, true); err != nil {
+		return nil, err
+	}
+	return loadReadOnly(db)
+}
+
+// loadReadOnly loads the keydir of the read only datastore db. A merge of
+// the writer may remove the files the manifest lists before they are
+// opened; the load then starts over on a new datastore with the new
+// manifest.
+func loadReadOnly(db *Bitcask) (*Bitcask, error) {
+	for {
+		err := db.load()
+		if err == nil {
+			return db, nil
+		}
+		db.closeDataFiles()
+		if err != errManifestChanged {
+			return nil, err
+		}
+		if db, err = newBitcask(db.directory, db.config); err != nil {
+			return nil, err
+		}
+		db.readOnly = true
+	}
+}
+
+// Refresh rebuilds the keydir of a datastore opened with OpenReadOnly from
+// the data and hint files currently on disk. The previous keydir is
+// served until the new one is complete.
+func (db *Bitcask) Refresh() error {
+	if !db.readOnly {
+		return errors.New("only a read only datastore can be refreshed")
+	}
+	fresh, err := newBitcask(db.directory, db.config)
+	if err != nil {
+		return err
+	}
+	fresh.readOnly = true
+	if fresh, err = loadReadOnly(fresh); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	old := db.dataFiles
+	db.keyDir = fresh.keyDir
+	db.index = fresh.index
+	db.dataFiles = fresh.dataFiles
+	db.order = fresh.order
+	db.nextFileID = fresh.nextFileID
+	db.version = fresh.version
+	db.expiring = fresh.expiring
+	db.cache.purge()
+	db.mu.Unlock()
+
+	for _, df := range old {
+		df.close()
+	}
+	return nil
+}
+
+func (db *Bitcask) closeDataFiles() {
+	for _, df := range db.dataFiles {
+		df.close()
+	}
+}
@@ -0,0 +1,163 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithMaxFileSize(64), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	db.Put("a", "1")
+
+	ro, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer ro.Close()
+	if _, v, _ := ro.Get("a"); v != "1" {
+		t.Errorf("expected %v but got %v", "1", v)
+	}
+
+	writes := map[string]func() error{
+		"put":    func() error { return ro.Put("b", "2") },
+		"delete": func() error { return ro.Delete("a") },
+		"batch": func() error {
+			b := NewBatch()
+			b.Put("b", "2")
+			return ro.Write(b)
+		},
+		"cas":   func() error { return ro.CompareAndSwap("a", "1", "2") },
+		"merge": ro.Merge,
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: expected %v but got %v", name, ErrReadOnly, err)
+		}
+	}
+
+	// Rotate the active file of the writer a few times.
+	for _, k := range []string{"b", "c", "d", "e"} {
+		db.Put(k, "value of "+k)
+	}
+	db.Delete("a")
+	if ro.HasKey("e") {
+		t.Errorf("expected %v to be missing before refresh", "e")
+	}
+	if err := ro.Refresh(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if w, g := db.Keys(), ro.Keys(); len(w) != len(g) {
+		t.Errorf("expected %v but got %v", w, g)
+	}
+	if _, v, _ := ro.Get("e"); v != "value of e" {
+		t.Errorf("expected %v but got %v", "value of e", v)
+	}
+}
+
+func TestOpenReadOnlyTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "1")
+	db.Close()
+
+	// A record the writer has not finished appending.
+	names := dataFileNames(dir)
+	f, _ := os.OpenFile(names[len(names)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0, 0})
+	f.Close()
+
+	ro, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer ro.Close()
+	if _, v, _ := ro.Get("a"); v != "1" {
+		t.Errorf("expected %v but got %v", "1", v)
+	}
+}
+
+func TestRefreshWhileMerging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithMaxFileSize(64), WithAutoMerge(false), WithCheckpointInterval(0))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	// Many small files keep a refresh opening them while a merge runs.
+	want := map[string]string{}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key%d", i)
+		want[k] = fmt.Sprintf("value%d", i)
+		db.Put(k, want[k])
+	}
+	readers := make([]*Bitcask, 4)
+	for i := range readers {
+		if readers[i], err = OpenReadOnly(dir); err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		defer readers[i].Close()
+	}
+
+	// Every merge removes the files a refresh may be about to open.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 40; i++ {
+			k := fmt.Sprintf("key%d", i)
+			db.Put(k, want[k])
+			if err := db.Merge(); err != nil {
+				t.Errorf("Non expected error: %s", err.Error())
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, ro := range readers {
+		wg.Add(1)
+		go func(ro *Bitcask) {
+			defer wg.Done()
+			for running := true; running; {
+				select {
+				case <-done:
+					running = false
+				default:
+				}
+				if err := ro.Refresh(); err != nil {
+					t.Errorf("Non expected error: %s", err.Error())
+					return
+				}
+			}
+			checkMergeStore(t, ro, want)
+		}(ro)
+	}
+	wg.Wait()
+	<-done
+}
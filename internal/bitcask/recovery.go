@@ -0,0 +1,138 @@
+package bitcask
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+const quarantineDir = "quarantine"
+
+// RecoveredFile describes a data file repaired by Open in recovery mode.
+type RecoveredFile struct {
+	// Name is the base name of the data file.
+	Name string
+	// Offset is the size of the valid prefix of the file.
+	Offset int64
+	// LostBytes is the amount of data dropped from the store.
+	LostBytes int64
+	// Quarantined is true if the file was moved to the quarantine
+	// directory instead of being truncated.
+	Quarantined bool
+	// Err describes the first invalid record.
+	Err string
+}
+
+// Recovery summarises the data dropped by Open in recovery mode.
+type Recovery struct {
+	Files []RecoveredFile
+}
+
+// LostBytes returns the total amount of data dropped from the store.
+func (r Recovery) LostBytes() int64 {
+	var n int64
+	for _, f := range r.Files {
+		n += f.LostBytes
+	}
+	return n
+}
+
+// Recovery returns the summary of the repairs made when the store was
+// opened with WithRecovery.
+func (db *Bitcask) Recovery() Recovery {
+	return db.recovery
+}
+
+// recoverDataFile validates every record of df. The newest file is
+// truncated after its last valid record, older ones are quarantined.
+func (db *Bitcask) recoverDataFile(df *dataFile, newest bool, now uint32) error {
+	entries, valid, err := db.readDataFile(df, df.format.fileHeaderLen())
+	hintValid := false
+	if df.hr != nil {
+		_, herr := db.readHintFile(df)
+		hintValid = herr == nil
+		df.hr.Close()
+		df.hr = nil
+	}
+	if err != nil && !newest {
+		return db.quarantine(df, valid, err)
+	}
+	if err != nil {
+		if err := os.Truncate(df.name, valid); err != nil {
+			return err
+		}
+		db.recovery.Files = append(db.recovery.Files, RecoveredFile{
+			Name:      filepath.Base(df.name),
+			Offset:    valid,
+			LostBytes: df.offset - valid,
+			Err:       err.Error(),
+		})
+		df.offset = valid
+		df.stat.totalbytes = int(valid)
+	}
+	if err != nil || newest || !hintValid {
+		if err := db.writeHintFile(df, entries); err != nil {
+			return err
+		}
+	}
+	db.dataFiles[df.id] = df
+	db.order = append(db.order, df.id)
+	db.replay(entries, now)
+	return nil
+}
+
+// quarantine moves a corrupt data file and its hint file out of the store.
+func (db *Bitcask) quarantine(df *dataFile, valid int64, cause error) error {
+	df.close()
+	dir := filepath.Join(db.directory, quarantineDir)
+	if err := os.MkdirAll(dir, db.config.dirPerm); err != nil {
+		return err
+	}
+	name := filepath.Base(df.name)
+	if err := os.Rename(df.name, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	if err := os.Rename(df.name+".hint", filepath.Join(dir, name+".hint")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db.recovery.Files = append(db.recovery.Files, RecoveredFile{
+		Name:        name,
+		Offset:      valid,
+		LostBytes:   df.offset,
+		Quarantined: true,
+		Err:         cause.Error(),
+	})
+	return nil
+}
+
+// writeHintFile replaces the hint file of df with one for entries.
+func (db *Bitcask) writeHintFile(df *dataFile, entries []keyDirEntry) error {
+	var buf bytes.Buffer
+	if df.format != formatV0 {
+		buf.Write(fileHeader(df.id, fileHint))
+	}
+	for i := range entries {
+		encodeKeyEntry(&buf, &entries[i], db.aead)
+	}
+	tmp := df.name + ".hint.tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, db.config.filePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, df.name+".hint"); err != nil {
+		return err
+	}
+	df.hint = true
+	return nil
+}
@@ -0,0 +1,111 @@
+package bitcask
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func dataFileNames(dir string) []string {
+	names, _ := filepath.Glob(filepath.Join(dir, "*.bitcask.data"))
+	sort.Strings(names)
+	return names
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "1")
+	db.Put("b", "2")
+	db.Close()
+
+	names := dataFileNames(dir)
+	last := names[len(names)-1]
+	f, _ := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 1, 0, 0})
+	f.Close()
+	os.Remove(last + ".hint")
+
+	if _, err := Open(dir); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected %v but got %v", ErrCorrupt, err)
+	}
+
+	db, err = Open(dir, WithRecovery(true))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	r := db.Recovery()
+	if len(r.Files) != 1 || r.Files[0].Name != filepath.Base(last) || r.LostBytes() != 10 {
+		t.Errorf("expected %s truncated by 10 bytes but got %+v", filepath.Base(last), r)
+	}
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if _, got, _ := db.Get(k); got != v {
+			t.Errorf("expected %v but got %v", v, got)
+		}
+	}
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	if _, got, _ := db.Get("b"); got != "2" {
+		t.Errorf("expected %v but got %v", "2", got)
+	}
+}
+
+func TestRecoverCorruptImmutableFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("old", "value")
+	db.Close()
+	db, err = Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("new", "value")
+	db.Close()
+
+	names := dataFileNames(dir)
+	first := names[0]
+	data, _ := ioutil.ReadFile(first)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(first, data, 0644)
+
+	db, err = Open(dir, WithRecovery(true), WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	r := db.Recovery()
+	if len(r.Files) != 1 || !r.Files[0].Quarantined || r.LostBytes() != int64(len(data)) {
+		t.Errorf("expected %s to be quarantined but got %+v", filepath.Base(first), r)
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineDir, filepath.Base(first))); err != nil {
+		t.Errorf("expected quarantined file: %v", err)
+	}
+	if db.HasKey("old") || !db.HasKey("new") {
+		t.Errorf("expected only the new key but got %v", db.Keys())
+	}
+}
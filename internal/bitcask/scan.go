@@ -0,0 +1,92 @@
+package bitcask
+
+import "strings"
+
+// Iterator walks keys in ascending order. It does not hold db.mu between
+// calls to Next, so writes made during the walk may or may not be seen.
+//
+//	it := db.Scan([]byte("tenant/123/"))
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	db     *Bitcask
+	seek   string
+	prefix string
+	end    string
+	key    []byte
+	value  []byte
+	err    error
+	done   bool
+}
+
+// Scan returns an iterator over the keys starting with prefix.
+func (db *Bitcask) Scan(prefix []byte) *Iterator {
+	return &Iterator{
+		db:     db,
+		seek:   string(prefix),
+		prefix: string(prefix),
+	}
+}
+
+// Range returns an iterator over the keys from start, inclusive, to end,
+// exclusive. An empty end iterates up to the last key.
+func (db *Bitcask) Range(start, end []byte) *Iterator {
+	return &Iterator{
+		db:   db,
+		seek: string(start),
+		end:  string(end),
+	}
+}
+
+// Next advances to the next key and reads its value. It returns false when
+// the iteration is over or an error occurred.
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+	db := it.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := unixNow()
+	for n := db.index.seek(it.seek); n != skipEnd; n = db.index.next(n) {
+		kd := db.keyDir.at(n)
+		key := string(kd.key)
+		if !strings.HasPrefix(key, it.prefix) || (it.end != "" && key >= it.end) {
+			break
+		}
+		if kd.expired(now) {
+			continue
+		}
+		// The smallest key after key.
+		it.seek = key + "\x00"
+		it.key = kd.key
+		it.value, it.err = db.read(&kd)
+		if it.err != nil {
+			break
+		}
+		return true
+	}
+	it.done = true
+	it.key, it.value = nil, nil
+	return false
+}
+
+// Key returns the current key. The slice must not be modified.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current key.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,122 @@
+package bitcask
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	dir := newKeyDir()
+	s := newSkiplist(dir)
+	keys := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		k := strconv.Itoa(i * 7 % 200)
+		_, ent, _ := dir.put(keyDirEntry{key: []byte(k)})
+		s.insert(k, ent)
+		s.insert(k, ent)
+		keys = append(keys, k)
+	}
+	for i := 0; i < 200; i += 3 {
+		s.remove(strconv.Itoa(i))
+		dir.remove(strconv.Itoa(i))
+	}
+	var want []string
+	for _, k := range keys {
+		if n, _ := strconv.Atoi(k); n%3 != 0 {
+			want = append(want, k)
+		}
+	}
+	sort.Strings(want)
+	var got []string
+	for n := s.seek(""); n != skipEnd; n = s.next(n) {
+		got = append(got, string(dir.key(&dir.entries[n])))
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	// Entries and links of removed keys are reused.
+	rnd := rand.New(rand.NewSource(1))
+	live := map[string]bool{}
+	for _, k := range want {
+		live[k] = true
+	}
+	for i := 0; i < 5000; i++ {
+		k := strconv.Itoa(rnd.Intn(300))
+		if live[k] {
+			s.remove(k)
+			dir.remove(k)
+			delete(live, k)
+			continue
+		}
+		_, ent, _ := dir.put(keyDirEntry{key: []byte(k)})
+		s.insert(k, ent)
+		live[k] = true
+	}
+	want = want[:0]
+	for k := range live {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	got = got[:0]
+	for n := s.seek("15"); n != skipEnd; n = s.next(n) {
+		got = append(got, string(dir.key(&dir.entries[n])))
+	}
+	if i := sort.SearchStrings(want, "15"); !reflect.DeepEqual(want[i:], got) {
+		t.Errorf("expected %v but got %v", want[i:], got)
+	}
+}
+
+func TestScanAndRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	for _, k := range []string{"tenant/2/b", "tenant/1/a", "tenant/10/a", "tenant/1/b", "other", "tenant/1/c"} {
+		db.Put(k, "v-"+k)
+	}
+	db.Delete("tenant/1/c")
+
+	collect := func(it *Iterator) []string {
+		var ks []string
+		for it.Next() {
+			if string(it.Value()) != "v-"+string(it.Key()) {
+				t.Errorf("expected %v but got %v", "v-"+string(it.Key()), string(it.Value()))
+			}
+			ks = append(ks, string(it.Key()))
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("Non expected error: %s", err.Error())
+		}
+		return ks
+	}
+	tests := map[string]struct {
+		it   *Iterator
+		want []string
+	}{
+		"prefix":    {db.Scan([]byte("tenant/1/")), []string{"tenant/1/a", "tenant/1/b"}},
+		"no match":  {db.Scan([]byte("none")), nil},
+		"range":     {db.Range([]byte("tenant/1/b"), []byte("tenant/2/b")), []string{"tenant/1/b", "tenant/10/a"}},
+		"open end":  {db.Range([]byte("tenant/10"), nil), []string{"tenant/10/a", "tenant/2/b"}},
+		"all":       {db.Scan(nil), []string{"other", "tenant/1/a", "tenant/1/b", "tenant/10/a", "tenant/2/b"}},
+		"past last": {db.Range([]byte("tenant/2/c"), nil), nil},
+	}
+	for name, tt := range tests {
+		if got := collect(tt.it); !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("%s: expected %v but got %v", name, tt.want, got)
+		}
+	}
+}
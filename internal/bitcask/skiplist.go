@@ -0,0 +1,159 @@
+package bitcask
+
+import (
+	"math/rand"
+	"unsafe"
+)
+
+const (
+	maxLevel = 32
+	// levelP is the inverse probability of a node reaching the next level.
+	levelP = 4
+	// skipEnd is returned by seek and next past the last key.
+	skipEnd = ^uint32(0)
+)
+
+// skipNode locates the forward links of a node in the links arena.
+type skipNode struct {
+	off   uint32
+	level uint8
+}
+
+// skiplist keeps the keys of the keydir in ascending order so that they
+// can be listed by prefix or range. The node of a key is stored under the
+// number of its keydir entry and refers to the following nodes by their
+// entry number plus one, or zero at the end, so that like the keydir it
+// holds no pointers for the garbage collector to scan. It is not safe for
+// concurrent use.
+type skiplist struct {
+	dir *keyDir
+	// nodes holds the node of every entry number, with a zero level for
+	// the entries without one.
+	nodes []skipNode
+	links []uint32
+	// free holds the offsets of the unused links of the nodes of each
+	// level.
+	free  [maxLevel][]uint32
+	head  [maxLevel]uint32
+	level int
+	rnd   *rand.Rand
+}
+
+func newSkiplist(dir *keyDir) *skiplist {
+	return &skiplist{
+		dir:   dir,
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// key returns the key of node n, an entry number plus one.
+func (s *skiplist) key(n uint32) []byte {
+	return s.dir.key(&s.dir.entries[n-1])
+}
+
+// link returns the link on level i of node n, or of the head when n is
+// zero. It is only valid until the next node is inserted.
+func (s *skiplist) link(n uint32, i int) *uint32 {
+	if n == 0 {
+		return &s.head[i]
+	}
+	return &s.links[s.nodes[n-1].off+uint32(i)]
+}
+
+func (s *skiplist) randomLevel() int {
+	level := 1
+	for level < maxLevel && s.rnd.Intn(levelP) == 0 {
+		level++
+	}
+	return level
+}
+
+// path returns the last node before key on every level.
+func (s *skiplist) path(key string) [maxLevel]uint32 {
+	var prev [maxLevel]uint32
+	n := uint32(0)
+	for i := s.level - 1; i >= 0; i-- {
+		for next := *s.link(n, i); next != 0 && string(s.key(next)) < key; next = *s.link(n, i) {
+			n = next
+		}
+		prev[i] = n
+	}
+	return prev
+}
+
+// insert adds key, the key of the keydir entry ent, unless it is already
+// present.
+func (s *skiplist) insert(key string, ent uint32) {
+	prev := s.path(key)
+	if n := *s.link(prev[0], 0); n != 0 && string(s.key(n)) == key {
+		return
+	}
+	level := s.randomLevel()
+	for i := s.level; i < level; i++ {
+		prev[i] = 0
+	}
+	if level > s.level {
+		s.level = level
+	}
+	for int(ent) >= len(s.nodes) {
+		s.nodes = append(s.nodes, skipNode{})
+	}
+	s.nodes[ent] = skipNode{off: s.alloc(level), level: uint8(level)}
+	n := ent + 1
+	for i := 0; i < level; i++ {
+		*s.link(n, i) = *s.link(prev[i], i)
+		*s.link(prev[i], i) = n
+	}
+}
+
+// alloc returns the offset of level unused links.
+func (s *skiplist) alloc(level int) uint32 {
+	if free := s.free[level-1]; len(free) > 0 {
+		s.free[level-1] = free[:len(free)-1]
+		return free[len(free)-1]
+	}
+	off := uint32(len(s.links))
+	s.links = append(s.links, make([]uint32, level)...)
+	return off
+}
+
+// remove deletes key if it is present. It must be called before the key
+// is removed from the keydir.
+func (s *skiplist) remove(key string) {
+	prev := s.path(key)
+	n := *s.link(prev[0], 0)
+	if n == 0 || string(s.key(n)) != key {
+		return
+	}
+	node := s.nodes[n-1]
+	for i := 0; i < int(node.level); i++ {
+		*s.link(prev[i], i) = *s.link(n, i)
+	}
+	s.free[node.level-1] = append(s.free[node.level-1], node.off)
+	s.nodes[n-1] = skipNode{}
+	for s.level > 1 && s.head[s.level-1] == 0 {
+		s.level--
+	}
+}
+
+// seek returns the entry number of the first key not less than key, or
+// skipEnd.
+func (s *skiplist) seek(key string) uint32 {
+	return *s.link(s.path(key)[0], 0) - 1
+}
+
+// next returns the entry number of the key after the key of entry ent, or
+// skipEnd.
+func (s *skiplist) next(ent uint32) uint32 {
+	return *s.link(ent+1, 0) - 1
+}
+
+// memory returns the size of the nodes and their links.
+func (s *skiplist) memory() int64 {
+	n := int64(cap(s.nodes))*int64(unsafe.Sizeof(skipNode{})) + int64(cap(s.links))*4
+	for _, free := range s.free {
+		n += int64(cap(free)) * 4
+	}
+	return n
+}
@@ -0,0 +1,114 @@
+package bitcask
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// written accounts n bytes appended to the file with the given timestamp.
+func (s *status) written(n int, timestamp int64) {
+	s.totalbytes += n
+	s.seen(timestamp)
+}
+
+func (s *status) seen(timestamp int64) {
+	if s.oldestTstamp == 0 || timestamp < s.oldestTstamp {
+		s.oldestTstamp = timestamp
+	}
+	if timestamp > s.newestTstamp {
+		s.newestTstamp = timestamp
+	}
+}
+
+func (s *status) update() {
+	if s.totalbytes == 0 {
+		s.fragmented = 0
+		return
+	}
+	s.fragmented = s.deadbytes * 100 / s.totalbytes
+}
+
+// computeStats derives the dead bytes of every data file from the live
+// entries of the keydir. The file header is never dead.
+func (db *Bitcask) computeStats() {
+	live := make(map[int64]int, len(db.dataFiles))
+	for _, df := range db.dataFiles {
+		df.stat.oldestTstamp, df.stat.newestTstamp = 0, 0
+	}
+	db.keyDir.each(func(kd keyDirEntry) bool {
+		live[kd.fileID] += int(kd.recordSize())
+		if df, ok := db.dataFiles[kd.fileID]; ok {
+			df.stat.seen(kd.timestamp)
+		}
+		return true
+	})
+	for id, df := range db.dataFiles {
+		df.stat.deadbytes = df.stat.totalbytes - int(df.format.fileHeaderLen()) - live[id]
+		df.stat.update()
+	}
+}
+
+// markDead accounts the entries backing kd as dead and schedules a merge
+// when their file crosses a threshold. The caller must hold db.mu.
+func (db *Bitcask) markDead(kd *keyDirEntry) {
+	df, ok := db.dataFiles[kd.fileID]
+	if !ok {
+		return
+	}
+	df.stat.deadbytes += int(kd.recordSize())
+	df.stat.update()
+	if df != db.activeFile && db.mergeNeeded(df) {
+		db.scheduleMerge()
+	}
+}
+
+// mergeNeeded returns true if df crossed the fragmentation or the dead
+// bytes threshold.
+func (db *Bitcask) mergeNeeded(df *dataFile) bool {
+	if db.config.fragmentation > 0 && df.stat.fragmented >= db.config.fragmentation {
+		return true
+	}
+	return db.config.deadBytesThreshold > 0 && int64(df.stat.deadbytes) >= db.config.deadBytesThreshold
+}
+
+func (db *Bitcask) scheduleMerge() {
+	select {
+	case db.mergeCh <- struct{}{}:
+	default:
+	}
+}
+
+// merger runs the scheduled merges, at most one per interval. Close
+// cancels a merge in progress.
+func (db *Bitcask) merger(interval time.Duration) {
+	defer db.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-db.done
+		cancel()
+	}()
+	opts := MergeOptions{Policy: db.config.mergePolicy, BytesPerSec: db.config.mergeRate}
+	var last time.Time
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-db.mergeCh:
+		}
+		if wait := interval - time.Since(last); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-db.done:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+		last = time.Now()
+		if _, err := db.MergeContext(ctx, opts); err != nil && ctx.Err() == nil {
+			log.Printf("bitcask: merging data files: %s", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package bitcask
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func fragmentedFiles(db *Bitcask) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	n := 0
+	for _, df := range db.dataFiles {
+		if df != db.activeFile && db.mergeNeeded(df) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDeadBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	db.Put("a", "value")
+	db.Put("b", "value")
+	db.Put("a", "value2")
+	df := db.activeFile
+	header := currentFormat.headerLen(flagVersion)
+	want := header + 1 + 5
+	if df.stat.deadbytes != want {
+		t.Errorf("expected %d but got %d", want, df.stat.deadbytes)
+	}
+	total := df.stat.totalbytes
+	db.Close()
+
+	db, err = Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	df = db.dataFiles[df.id]
+	if df.stat.totalbytes != total || df.stat.deadbytes != want {
+		t.Errorf("expected %d/%d but got %d/%d", want, total, df.stat.deadbytes, df.stat.totalbytes)
+	}
+	if df.stat.fragmented != want*100/total {
+		t.Errorf("expected %d but got %d", want*100/total, df.stat.fragmented)
+	}
+
+	db.Delete("b")
+	want += header + 1 + 5
+	if df.stat.deadbytes != want {
+		t.Errorf("expected %d but got %d", want, df.stat.deadbytes)
+	}
+	if d := db.activeFile.stat.deadbytes; d != header+1 {
+		t.Errorf("expected tombstone of %d bytes but got %d", header+1, d)
+	}
+}
+
+func TestAutoMerge(t *testing.T) {
+	tests := map[string]struct {
+		autoMerge bool
+		merged    bool
+	}{
+		"enabled":  {autoMerge: true, merged: true},
+		"disabled": {autoMerge: false, merged: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bitcask_dir_")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(dir,
+				WithMaxFileSize(128),
+				WithMergeInterval(0),
+				WithAutoMerge(tc.autoMerge))
+			if err != nil {
+				t.Fatalf("Non expected error: %s", err.Error())
+			}
+			defer db.Close()
+			for i := 0; i < 100; i++ {
+				db.Put("key", "value")
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for fragmentedFiles(db) != 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if merged := fragmentedFiles(db) == 0; merged != tc.merged {
+				t.Errorf("expected merged %v but got %v", tc.merged, merged)
+			}
+			if _, v, _ := db.Get("key"); v != "value" {
+				t.Errorf("expected %v but got %v", "value", v)
+			}
+		})
+	}
+}
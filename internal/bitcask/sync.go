@@ -0,0 +1,128 @@
+package bitcask
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when the writes are flushed to stable storage.
+type SyncPolicy struct {
+	always   bool
+	interval time.Duration
+}
+
+var (
+	// SyncNever leaves flushing to the operating system. Writes acknowledged
+	// before a crash of the machine may be lost.
+	SyncNever = SyncPolicy{}
+	// SyncAlways makes every write durable before it returns. Concurrent
+	// writers share a single fsync.
+	SyncAlways = SyncPolicy{always: true}
+)
+
+// SyncInterval flushes the writes in the background every d. At most the
+// writes of the last interval are lost on a crash of the machine.
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{interval: d}
+}
+
+// groupCommit batches the fsyncs of concurrent writers. A writer waiting
+// for its write either starts a sync that covers every write logged so far
+// or waits for the sync that is already running.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written uint64
+	synced  uint64
+	syncing bool
+	err     error
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// logged counts a write appended to the active file.
+func (g *groupCommit) logged() {
+	g.mu.Lock()
+	g.written++
+	g.mu.Unlock()
+}
+
+// wait returns once every write logged before the call is synced.
+func (g *groupCommit) wait(sync func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seq := g.written
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		target := g.written
+		g.mu.Unlock()
+		err := sync()
+		g.mu.Lock()
+		g.syncing = false
+		g.synced, g.err = target, err
+		g.cond.Broadcast()
+	}
+	return g.err
+}
+
+// update runs fn under db.mu and then waits until its writes are durable
+// as the sync policy requires.
+func (db *Bitcask) update(fn func() error) error {
+	db.mu.Lock()
+	err := fn()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !db.config.sync.always {
+		return nil
+	}
+	return db.group.wait(db.Sync)
+}
+
+// Sync flushes the active data file and then its hint file to stable
+// storage.
+func (db *Bitcask) Sync() error {
+	if db.readOnly {
+		return nil
+	}
+	db.mu.RLock()
+	df := db.activeFile
+	db.mu.RUnlock()
+	// A file rotated in the meantime was synced before it was closed.
+	if err := df.w.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	if err := df.hw.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// syncer flushes the writes every interval.
+func (db *Bitcask) syncer(interval time.Duration) {
+	defer db.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-t.C:
+			if err := db.Sync(); err != nil {
+				log.Printf("bitcask: syncing data files: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package bitcask
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	g := newGroupCommit()
+	var syncs int32
+	var synced uint64
+	flush := func() error {
+		atomic.AddInt32(&syncs, 1)
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.logged()
+			if err := g.wait(flush); err != nil {
+				t.Errorf("Non expected error: %s", err.Error())
+			}
+			atomic.AddUint64(&synced, 1)
+		}()
+	}
+	wg.Wait()
+	if synced != 50 {
+		t.Errorf("expected %d but got %d", 50, synced)
+	}
+	if n := atomic.LoadInt32(&syncs); n == 0 || n >= 50 {
+		t.Errorf("expected writers to share syncs but got %d syncs", n)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	tests := map[string]SyncPolicy{
+		"never":    SyncNever,
+		"always":   SyncAlways,
+		"interval": SyncInterval(5 * time.Millisecond),
+	}
+	for name, policy := range tests {
+		dir, err := ioutil.TempDir("", "bitcask_dir_")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := Open(dir, WithSync(policy), WithMaxFileSize(256))
+		if err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := db.Put(strconv.Itoa(i), "value"); err != nil {
+					t.Errorf("%s: Non expected error: %s", name, err.Error())
+				}
+			}(i)
+		}
+		wg.Wait()
+		time.Sleep(10 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Errorf("%s: Non expected error: %s", name, err.Error())
+		}
+		db.Close()
+
+		db, err = Open(dir)
+		if err != nil {
+			t.Fatalf("Non expected error: %s", err.Error())
+		}
+		if n := db.Size(); n != 20 {
+			t.Errorf("%s: expected %d but got %d", name, 20, n)
+		}
+		db.Close()
+	}
+
+	if _, err := Open(os.TempDir(), WithSync(SyncInterval(-time.Second))); err == nil {
+		t.Errorf("expected an error for a negative sync interval")
+	}
+}
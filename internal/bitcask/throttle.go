@@ -0,0 +1,43 @@
+package bitcask
+
+import (
+	"context"
+	"time"
+)
+
+// throttle paces I/O to a number of bytes per second. A nil throttle or
+// one with a zero rate does not wait.
+type throttle struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait accounts n bytes and sleeps until they fit the rate. It returns
+// early with the error of ctx when ctx is done.
+func (t *throttle) wait(ctx context.Context, n int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t == nil || t.rate <= 0 {
+		return nil
+	}
+	t.n += n
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
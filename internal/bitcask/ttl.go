@@ -0,0 +1,99 @@
+package bitcask
+
+import (
+	"log"
+	"time"
+)
+
+func unixNow() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// expiryAfter returns the first second at which a key written now with
+// the given ttl is no longer visible.
+func expiryAfter(ttl time.Duration) uint32 {
+	t := time.Now().Add(ttl)
+	expiry := t.Unix()
+	if t.Nanosecond() > 0 {
+		expiry++
+	}
+	return uint32(expiry)
+}
+
+// PutWithTTL adds a key value to the database that expires after ttl.
+func (db *Bitcask) PutWithTTL(key, value string, ttl time.Duration) error {
+	return db.PutBytesWithTTL([]byte(key), []byte(value), ttl)
+}
+
+// PutBytesWithTTL adds a key value to the database that expires after ttl.
+// The slices are not retained.
+func (db *Bitcask) PutBytesWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.put(key, value, expiryAfter(ttl))
+}
+
+// sweepBatch is the number of tombstones sweep writes each time it takes
+// db.mu for writing.
+const sweepBatch = 1024
+
+// sweep replaces the expired keys with tombstones. The keys are collected
+// under the read lock, and the write lock is taken for a batch of
+// tombstones at a time, so that writers are not held up by the scan.
+func (db *Bitcask) sweep() error {
+	db.mu.RLock()
+	if db.expiring == 0 {
+		db.mu.RUnlock()
+		return nil
+	}
+	now := unixNow()
+	var expired []string
+	db.keyDir.each(func(kd keyDirEntry) bool {
+		if kd.expired(now) {
+			expired = append(expired, string(kd.key))
+		}
+		return true
+	})
+	db.mu.RUnlock()
+
+	for len(expired) > 0 {
+		n := minInt(sweepBatch, len(expired))
+		if err := db.sweepKeys(expired[:n], now); err != nil {
+			return err
+		}
+		expired = expired[n:]
+	}
+	return nil
+}
+
+// sweepKeys writes tombstones for the keys that are still expired at now.
+// A key written again since it was collected is kept.
+func (db *Bitcask) sweepKeys(keys []string, now uint32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, k := range keys {
+		if kd, ok := db.keyDir.get(k); ok && kd.expired(now) {
+			if err := db.delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *Bitcask) sweeper(interval time.Duration) {
+	defer db.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-t.C:
+			if err := db.sweep(); err != nil {
+				log.Printf("bitcask: sweeping expired keys: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package bitcask
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask_dir_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSweepInterval(0), WithChunkSize(4))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if err := db.PutWithTTL("session", "token", 0); err != ErrInvalidTTL {
+		t.Errorf("expected %v but got %v", ErrInvalidTTL, err)
+	}
+	db.PutWithTTL("session", "token", time.Second)
+	db.PutWithTTL("chunked", "chunked token", time.Second)
+	db.PutWithTTL("later", "token", time.Hour)
+	db.Put("keep", "value")
+	if _, v, _ := db.Get("session"); v != "token" {
+		t.Errorf("expected %v but got %v", "token", v)
+	}
+	if s := db.Size(); s != 4 {
+		t.Errorf("expected %d but got %d", 4, s)
+	}
+
+	time.Sleep(2 * time.Second)
+	for _, k := range []string{"session", "chunked"} {
+		if _, v, _ := db.Get(k); v != "" {
+			t.Errorf("expected expired key %s but got %v", k, v)
+		}
+		if db.HasKey(k) {
+			t.Errorf("expected key %s to be expired", k)
+		}
+	}
+	want := []string{"keep", "later"}
+	if got := db.Keys(); !reflect.DeepEqual(want, got) {
+		t.Errorf("expected: %v, got: %v", want, got)
+	}
+	if s := db.Size(); s != 2 {
+		t.Errorf("expected %d but got %d", 2, s)
+	}
+
+	if err := db.sweep(); err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	if _, ok := db.keyDir.get("session"); ok || db.expiring != 1 {
+		t.Errorf("expected expired keys to be swept, expiring %d", db.expiring)
+	}
+	db.Close()
+
+	db, err = Open(dir, WithAutoMerge(false))
+	if err != nil {
+		t.Fatalf("Non expected error: %s", err.Error())
+	}
+	defer db.Close()
+	if got := db.Keys(); !reflect.DeepEqual(want, got) {
+		t.Errorf("expected: %v, got: %v", want, got)
+	}
+	if kd, _ := db.keyDir.get("later"); kd.flags&flagExpiry == 0 || kd.expiry == 0 {
+		t.Errorf("expected expiry to be loaded but got %v", kd)
+	}
+}